@@ -0,0 +1,160 @@
+// cdn.go - CDN profiles.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of amper, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package amper
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+const (
+	// DefaultBingCDNDomain is the default domain of Bing AMP cache.
+	DefaultBingCDNDomain = "bing-amp.com"
+)
+
+// CDNProfile describes how to reach the origin via a CDN.
+type CDNProfile interface {
+	// Host returns the CDN host serving the origin host.
+	Host(host string) string
+	// Path returns the CDN path of the origin path p on host.
+	Path(host, p string) string
+	// Query returns the query parameters the CDN requires.
+	Query() url.Values
+	// BytesRange returns the default bytes range to request.
+	// Empty string means to request the whole page.
+	BytesRange() string
+	// CheckResponse returns an error if resp does not carry a page.
+	// Errors about HTTP status are expected to be *StatusError.
+	CheckResponse(resp *http.Response) error
+}
+
+// FrontedProfile is a CDNProfile with its own fronts, which
+// Client uses for the CDN instead of Front and FrontPool.
+type FrontedProfile interface {
+	CDNProfile
+	// FrontPool returns the fronts serving the CDN,
+	// or nil if the profile has none.
+	FrontPool() *FrontPool
+}
+
+// hostToAMPHost transforms a DNS name into the name AMP CDN accepts.
+// If cdnDomain is empty, DefaultCDNDomain is used.
+func hostToAMPHost(cdnDomain, host string) string {
+	if cdnDomain == "" {
+		cdnDomain = DefaultCDNDomain
+	}
+	return AMPCacheSubdomain(host) + "." + cdnDomain
+}
+
+// checkPage accepts full and partial responses carrying HTML.
+// AMP caches redirect to the origin the documents they do not
+// serve, e.g. the ones which fail AMP validation, so redirects
+// are reported along with their location.
+func checkPage(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	default:
+		serr := NewStatusError(resp)
+		serr.Location = resp.Header.Get("Location")
+		return serr
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "text/html" {
+		return &DecodeError{Err: ErrNotPage}
+	}
+	return nil
+}
+
+// GoogleAMPCache is the CDNProfile of Google AMP cache.
+type GoogleAMPCache struct {
+	// Domain is the domain suffix of the cache.
+	// If empty, DefaultCDNDomain is used.
+	Domain string
+	// Fronts are the fronts serving the cache, e.g. Google domains.
+	// If nil, the fronts of Client are used.
+	Fronts *FrontPool
+}
+
+func (p GoogleAMPCache) FrontPool() *FrontPool {
+	return p.Fronts
+}
+
+func (p GoogleAMPCache) Host(host string) string {
+	return hostToAMPHost(p.Domain, host)
+}
+
+// Path returns the path of the AMP viewer document.
+func (p GoogleAMPCache) Path(host, reqPath string) string {
+	return path.Join("v", "s", host, reqPath)
+}
+
+func (p GoogleAMPCache) Query() url.Values {
+	query := url.Values{}
+	query.Set("amp_js_v", "0.1")
+	return query
+}
+
+func (p GoogleAMPCache) BytesRange() string {
+	return DefaultBytesRange
+}
+
+// CheckResponse accepts HTML pages, including the partial ones
+// served for byte range requests, and reports the redirects
+// of the documents the cache does not serve.
+func (p GoogleAMPCache) CheckResponse(resp *http.Response) error {
+	return checkPage(resp)
+}
+
+// BingAMPCache is the CDNProfile of Bing AMP cache.
+type BingAMPCache struct {
+	// Domain is the domain suffix of the cache.
+	// If empty, DefaultBingCDNDomain is used.
+	Domain string
+	// Fronts are the fronts serving the cache, e.g. Bing domains.
+	// If nil, the fronts of Client are used.
+	Fronts *FrontPool
+}
+
+func (p BingAMPCache) FrontPool() *FrontPool {
+	return p.Fronts
+}
+
+func (p BingAMPCache) Host(host string) string {
+	domain := p.Domain
+	if domain == "" {
+		domain = DefaultBingCDNDomain
+	}
+	return hostToAMPHost(domain, host)
+}
+
+// Path returns the path of the cached document.
+func (p BingAMPCache) Path(host, reqPath string) string {
+	return path.Join("c", "s", host, reqPath)
+}
+
+func (p BingAMPCache) Query() url.Values {
+	return url.Values{}
+}
+
+// BytesRange requests the whole page, as Bing rewrites pages
+// and the payload offset differs from the origin one.
+func (p BingAMPCache) BytesRange() string {
+	return ""
+}
+
+// CheckResponse accepts HTML pages. Bing redirects to the origin
+// the documents it does not serve, as Google does.
+func (p BingAMPCache) CheckResponse(resp *http.Response) error {
+	return checkPage(resp)
+}
@@ -0,0 +1,143 @@
+package amper
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// recordingTransport records requests and serves them with Server.
+type recordingTransport struct {
+	server   *Server
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func (t *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.requests = append(t.requests, r)
+	t.mu.Unlock()
+	w := httptest.NewRecorder()
+	t.server.ServeHTTP(w, r)
+	return w.Result(), nil
+}
+
+func TestCDNProfiles(t *testing.T) {
+	is := is.New(t)
+	transport := &recordingTransport{server: &Server{Handler: echoHandler()}}
+	c := &Client{
+		Host:      "amp.example-host.org",
+		Transport: transport,
+		CDNProfiles: []CDNProfile{
+			GoogleAMPCache{Fronts: NewFrontPool("www.google.com")},
+			BingAMPCache{Fronts: NewFrontPool("www.bing.com")},
+		},
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := c.RoundTrip(bytes.NewReader([]byte("x")))
+		is.NoErr(err)
+		b, err := io.ReadAll(resp)
+		is.NoErr(err)
+		is.Equal(string(b), "x")
+	}
+
+	google := transport.requests[0]
+	is.Equal(google.Host, "amp-example--host-org.cdn.ampproject.org")
+	is.Equal(google.URL.Host, "www.google.com")
+	is.True(strings.HasPrefix(google.URL.Path, "/v/s/amp.example-host.org/"))
+	is.Equal(google.URL.Query().Get("amp_js_v"), "0.1")
+	is.Equal(google.Header.Get("Range"), "bytes="+DefaultBytesRange)
+
+	bing := transport.requests[1]
+	is.Equal(bing.Host, "amp-example--host-org.bing-amp.com")
+	is.Equal(bing.URL.Host, "www.bing.com")
+	is.True(strings.HasPrefix(bing.URL.Path, "/c/s/amp.example-host.org/"))
+	is.Equal(bing.URL.RawQuery, "")
+	is.Equal(bing.Header.Get("Range"), "")
+}
+
+// checkRoute tells whether the front of request r serves its CDN.
+func checkRoute(r *http.Request) bool {
+	switch {
+	case strings.HasSuffix(r.Host, ".bing-amp.com"):
+		return r.URL.Host == "www.bing.com"
+	case strings.HasSuffix(r.Host, "."+DefaultCDNDomain):
+		return r.URL.Host == "www.google.com"
+	}
+	return false
+}
+
+func TestCDNProfileFronts(t *testing.T) {
+	is := is.New(t)
+	transport := &recordingTransport{server: &Server{Handler: echoHandler()}}
+	c := &Client{
+		Host:      "amp.example.org",
+		Transport: transport,
+		CDNProfiles: []CDNProfile{
+			GoogleAMPCache{Fronts: NewFrontPool("www.google.com")},
+			BingAMPCache{Fronts: NewFrontPool("www.bing.com")},
+		},
+		HedgePolicy: &HedgePolicy{MaxHedges: 2, InitialDelay: time.Nanosecond},
+	}
+	for i := 0; i < 5; i++ {
+		resp, err := c.RoundTrip(bytes.NewReader([]byte("x")))
+		is.NoErr(err)
+		resp.Close()
+	}
+	transport.mu.Lock()
+	for _, r := range transport.requests {
+		is.True(checkRoute(r)) // the front must serve the CDN of the host
+	}
+	transport.mu.Unlock()
+
+	// Fronts of the client cannot serve several CDNs.
+	c = &Client{
+		Host:        "amp.example.org",
+		Front:       "www.google.com",
+		Transport:   transport,
+		CDNProfiles: []CDNProfile{GoogleAMPCache{}, BingAMPCache{}},
+	}
+	_, err := c.RoundTrip(bytes.NewReader([]byte("x")))
+	is.Equal(err, ErrProfileFronts)
+}
+
+func TestCDNCheckResponse(t *testing.T) {
+	is := is.New(t)
+	respond := func(code int, header http.Header, body string) *http.Response {
+		w := httptest.NewRecorder()
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(code)
+		io.WriteString(w, body)
+		return w.Result()
+	}
+	for _, cdn := range []CDNProfile{GoogleAMPCache{}, BingAMPCache{}} {
+		html := http.Header{"Content-Type": {"text/html; charset=utf-8"}}
+		is.NoErr(cdn.CheckResponse(respond(http.StatusOK, html, "<html></html>")))
+		is.NoErr(cdn.CheckResponse(respond(http.StatusPartialContent, html, "</html>")))
+
+		// Documents the cache does not serve are redirected to the origin.
+		err := cdn.CheckResponse(respond(http.StatusFound,
+			http.Header{"Location": {"https://amp.example.org/x"}}, ""))
+		var serr *StatusError
+		is.True(errors.As(err, &serr))
+		is.Equal(serr.StatusCode, http.StatusFound)
+		is.Equal(serr.Location, "https://amp.example.org/x")
+
+		// Error pages of the cache are not always HTML.
+		err = cdn.CheckResponse(respond(http.StatusOK,
+			http.Header{"Content-Type": {"application/json"}}, `{"error":"quota"}`))
+		var derr *DecodeError
+		is.True(errors.As(err, &derr))
+		is.True(errors.Is(err, ErrNotPage))
+	}
+}
@@ -8,13 +8,16 @@
 package amper
 
 import (
+	"bytes"
+	"context"
 	"errors"
-	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"path"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	ampcodec "github.com/unkaktus/amper/codec/amp"
 	getcodec "github.com/unkaktus/amper/codec/get"
@@ -29,23 +32,15 @@ const (
 	DefaultBytesRange = "12500-"
 )
 
-// hostToAMPHost transforms a DNS name into the name AMP CDN accepts.
-// If cdnDomain is empty, DefaultCDNDomain is used.
-func hostToAMPHost(cdnDomain, host string) string {
-	if cdnDomain == "" {
-		cdnDomain = DefaultCDNDomain
-	}
-	host = strings.Replace(host, "-", "--", -1)
-	host = strings.Replace(host, ".", "-", -1)
-	return host + "." + cdnDomain
-}
-
 // Client desribes a client state.
 type Client struct {
 	// Host is the hostname of the backend to use.
 	Host string
 	// Front is the hostname sent in TLS SNI.
 	Front string
+	// FrontPool, if set, is used to pick the front for each
+	// request instead of Front.
+	FrontPool *FrontPool
 	// Path is the prefix path for making requests.
 	Path string
 	// Transport is the http.RoundTripper to use to perform requests.
@@ -53,38 +48,288 @@ type Client struct {
 	Transport http.RoundTripper
 	// CDNDomain is the domain suffix of the AMP CDN.
 	// If empty, DefaultCDNDomain is used.
+	// It is ignored if CDNProfiles is set.
 	CDNDomain string
+	// CDNProfiles is the list of CDNs to use. Requests rotate
+	// through them in order. If empty, Google AMP cache
+	// at CDNDomain is used. With several profiles, fronting
+	// requires each of them to have its own fronts,
+	// as the fronts of one CDN do not serve the others.
+	CDNProfiles []CDNProfile
 	// Scheme specifies the URL scheme for accessing AMP CDN.
 	// Scheme is either "https" or "http".
 	// If empty, Scheme defaults to "https".
 	Scheme string
 	// Query specifies query parameters to set for the URL.
-	// Defaults to "amp_js_v=0.1".
+	// Defaults to the query the CDN profile requires.
 	Query url.Values
 	// BytesRange is the bytes range string (eg. "100-120")
 	// for the page to request.
-	// Defaults to DefaultBytesRange if not set.
+	// Defaults to the bytes range of the CDN profile if not set.
 	BytesRange string
+	// MaxFragmentSize enables fragmenting of upstream data
+	// if set. Requests carrying more than MaxFragmentSize
+	// bytes are split into several requests to fit into
+	// URL length limits of the CDN.
+	MaxFragmentSize int
+	// PathEncoder, if set, encodes requests into paths which hide
+	// their length with padding, random slugs and segments, and
+	// rotates through its path styles.
+	// If nil, requests are encoded with getcodec.Encode.
+	PathEncoder *getcodec.EncoderConfig
+	// RetryPolicy, if set, makes the client retry failed requests.
+	RetryPolicy *RetryPolicy
+	// HedgePolicy, if set, makes the client send hedged requests
+	// via other fronts and CDNs when a request is slow to complete.
+	HedgePolicy *HedgePolicy
+	// MaxResponseSize limits the size of reply data.
+	// Zero means no limit.
+	MaxResponseSize int64
+	// Carrier is the carrier of replies in the pages, which has
+	// to be the one of the server. If nil, ampcodec.PreCarrier is used.
+	Carrier ampcodec.Carrier
+	// Marker marks the elements carrying replies in the pages, which
+	// has to be the one of the server. If nil, ampcodec.FixedMarker is used.
+	Marker ampcodec.Marker
+	// Framed makes the client expect replies framed with their length
+	// and checksum, so that truncated or corrupted replies are detected.
+	// It has to be set for servers with Framed, Padding or Compress set.
+	Framed bool
+	// RequireStatus makes the client treat replies without
+	// an in-band status as broken, so that pages cut before
+	// the status are not taken for complete replies.
+	// It has to be unset for servers which do not send status.
+	RequireStatus bool
+
+	cdnIndex uint32
+}
+
+// cdnProfile returns the CDN profile for the next request.
+func (c *Client) cdnProfile() CDNProfile {
+	if len(c.CDNProfiles) == 0 {
+		return GoogleAMPCache{Domain: c.CDNDomain}
+	}
+	i := atomic.AddUint32(&c.cdnIndex, 1) - 1
+	return c.CDNProfiles[int(i)%len(c.CDNProfiles)]
+}
+
+// encode encodes request data from r into its path.
+func (c *Client) encode(r io.Reader) (string, error) {
+	if c.PathEncoder != nil {
+		return c.PathEncoder.Encode(r)
+	}
+	return getcodec.Encode(r)
+}
+
+// encodeFragments encodes request data from r into
+// the paths of its fragments.
+func (c *Client) encodeFragments(r io.Reader) ([]string, error) {
+	if c.PathEncoder != nil {
+		return c.PathEncoder.EncodeFragments(r, c.MaxFragmentSize)
+	}
+	return getcodec.EncodeFragments(r, c.MaxFragmentSize)
 }
 
 // RoundTrip writes data from reader r to the server and returns
 // reply from the server.
+// It is equivalent to RoundTripContext with context.Background().
 func (c *Client) RoundTrip(r io.Reader) (io.ReadCloser, error) {
-	reqPath, err := getcodec.Encode(r)
+	return c.RoundTripContext(context.Background(), r)
+}
+
+// RoundTripContext writes data from reader r to the server and returns
+// reply from the server. The provided context controls the entire
+// round trip, including reading and decoding of the response.
+// If ctx is canceled or its deadline is exceeded, the returned error
+// is a *CanceledError.
+// The reply is streamed out of the page unless RetryPolicy,
+// HedgePolicy or a FrontPool is set, in which case it is read
+// to the end first, so that its errors are retried and reported.
+// The caller has to close the reply to release the connection.
+func (c *Client) RoundTripContext(ctx context.Context, r io.Reader) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &CanceledError{Err: err}
+	}
+	if c.MaxFragmentSize == 0 {
+		reqPath, err := c.encode(r)
+		if err != nil {
+			return nil, err
+		}
+		return c.roundTripPath(ctx, reqPath)
+	}
+
+	data, err := io.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
+	if len(data) <= c.MaxFragmentSize {
+		reqPath, err := c.encode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return c.roundTripPath(ctx, reqPath)
+	}
+	reqPaths, err := c.encodeFragments(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	// All fragments but the last one get empty replies,
+	// and the last one gets the reply to the whole request.
+	last := len(reqPaths) - 1
+	for _, reqPath := range reqPaths[:last] {
+		resp, err := c.roundTripPath(ctx, reqPath)
+		if err != nil {
+			return nil, err
+		}
+		resp.Close()
+	}
+	return c.roundTripPath(ctx, reqPaths[last])
+}
+
+// roundTripPath requests reqPath from the server and
+// decodes the reply, retrying according to RetryPolicy.
+func (c *Client) roundTripPath(ctx context.Context, reqPath string) (io.ReadCloser, error) {
+	policy := c.RetryPolicy
+	if policy == nil {
+		return c.roundTripAttempt(ctx, reqPath)
+	}
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			reqPath = getcodec.Reslug(reqPath)
+		}
+		data, err := c.roundTripAttempt(ctx, reqPath)
+		if policy.OnAttempt != nil {
+			policy.OnAttempt(attempt, err)
+		}
+		if err == nil || attempt >= policy.MaxAttempts || !policy.retryable(err) {
+			return data, err
+		}
+		timer := time.NewTimer(policy.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, &CanceledError{Err: ctx.Err()}
+		}
+	}
+}
 
-	if c.Query == nil {
-		c.Query = url.Values{}
-		c.Query.Set("amp_js_v", "0.1")
+// roundTripAttempt makes a single attempt to request reqPath
+// from the server and decode the reply.
+func (c *Client) roundTripAttempt(ctx context.Context, reqPath string) (io.ReadCloser, error) {
+	if c.HedgePolicy != nil {
+		return c.roundTripHedged(ctx, reqPath)
+	}
+	r, err := c.pickRoute()
+	if err != nil {
+		return nil, err
+	}
+	return c.roundTripVia(ctx, reqPath, r)
+}
+
+// route is the CDN profile and the front a request is sent via.
+type route struct {
+	cdn   CDNProfile
+	front string
+	// pool is the pool the front is picked from, if any.
+	pool *FrontPool
+}
+
+// pickRoute returns the route of the next request, avoiding
+// the fronts in exclude if possible. The front is picked
+// among the fronts of the CDN profile if it has its own,
+// so that the front always serves the CDN.
+func (c *Client) pickRoute(exclude ...string) (*route, error) {
+	r := &route{
+		cdn:   c.cdnProfile(),
+		front: c.Front,
+		pool:  c.FrontPool,
+	}
+	if fp, ok := r.cdn.(FrontedProfile); ok && fp.FrontPool() != nil {
+		r.pool = fp.FrontPool()
+	} else if len(c.CDNProfiles) > 1 && (c.Front != "" || c.FrontPool != nil) {
+		return nil, ErrProfileFronts
+	}
+	if r.pool != nil {
+		r.front = r.pool.PickExcept(exclude...)
+	}
+	return r, nil
+}
+
+// buffered tells whether replies via route r are read to the end
+// within the attempt, as retries, hedging and health tracking
+// of fronts need the outcome of the whole reply.
+func (c *Client) buffered(r *route) bool {
+	return c.RetryPolicy != nil || c.HedgePolicy != nil || r.pool != nil
+}
+
+// readReply reads the reply in data to the end and closes it.
+func readReply(data io.ReadCloser) (io.ReadCloser, error) {
+	defer data.Close()
+	b, err := io.ReadAll(data)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+// roundTripVia requests reqPath from the server via route r,
+// and reports the outcome to the pool of its front.
+func (c *Client) roundTripVia(ctx context.Context, reqPath string, r *route) (io.ReadCloser, error) {
+	start := time.Now()
+	data, err := c.roundTripFront(ctx, reqPath, r.cdn, r.front)
+	if err == nil && c.buffered(r) {
+		data, err = readReply(data)
+	}
+	if r.pool == nil {
+		return data, err
+	}
+	var (
+		cerr  *CanceledError
+		sverr *ServerError
+	)
+	switch {
+	case errors.As(err, &cerr):
+		// Cancellation says nothing about the front.
+	case errors.As(err, &sverr):
+		// The front delivered the page of the server.
+		r.pool.Report(r.front, time.Since(start), nil)
+	default:
+		r.pool.Report(r.front, time.Since(start), err)
+	}
+	return data, err
+}
+
+// roundTripFront requests reqPath from the server
+// via front of cdn and decodes the reply.
+func (c *Client) roundTripFront(ctx context.Context, reqPath string, cdn CDNProfile, front string) (io.ReadCloser, error) {
+	query := c.Query
+	if query == nil {
+		query = cdn.Query()
+	}
+
+	// Styled paths may carry a part of request in query.
+	reqPath, reqQuery, ok := strings.Cut(reqPath, "?")
+	if ok {
+		values, err := url.ParseQuery(reqQuery)
+		if err != nil {
+			return nil, err
+		}
+		merged := url.Values{}
+		for k, v := range query {
+			merged[k] = v
+		}
+		for k, v := range values {
+			merged[k] = v
+		}
+		query = merged
 	}
 
 	// Compile plain URL
 	u := &url.URL{
 		Host:     c.Host,
 		Path:     path.Join(c.Path, reqPath),
-		RawQuery: c.Query.Encode(),
+		RawQuery: query.Encode(),
 	}
 
 	// Set the scheme
@@ -94,45 +339,125 @@ func (c *Client) RoundTrip(r io.Reader) (io.ReadCloser, error) {
 	case "http":
 		u.Scheme = "http"
 	default:
-		return nil, errors.New("unsupported scheme")
+		return nil, ErrUnsupportedScheme
 	}
 
 	// If we're doing fronting, rewrite the URL
-	if c.Front != "" {
-		u.Host = hostToAMPHost(c.CDNDomain, c.Host)
-		u.Path = path.Join("v", "s", c.Host, u.Path)
+	if front != "" {
+		u.Host = cdn.Host(c.Host)
+		u.Path = cdn.Path(c.Host, u.Path)
 	}
 
-	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	bytesRange := DefaultBytesRange
+	bytesRange := cdn.BytesRange()
 	if c.BytesRange != "" {
 		bytesRange = c.BytesRange
 	}
-	req.Header.Set("Range", "bytes="+bytesRange)
+	if bytesRange != "" {
+		req.Header.Set("Range", "bytes="+bytesRange)
+	}
 
 	transport := http.DefaultTransport
 	if c.Transport != nil {
 		transport = c.Transport
 	}
 
-	resp, err := frontier.New(transport, c.Front, "").RoundTrip(req)
+	// Frontier rewrites the URL host, so save it beforehand.
+	host := u.Host
+	resp, err := frontier.New(transport, front, "").RoundTrip(req)
 	if err != nil {
-		return nil, err
+		return nil, contextError(ctx, &TransportError{Front: front, Host: host, Err: err})
 	}
-	defer resp.Body.Close()
 
-	switch resp.StatusCode {
-	case http.StatusOK, http.StatusPartialContent:
-	default:
-		return nil, fmt.Errorf("http status code %d", resp.StatusCode)
+	if err := cdn.CheckResponse(resp); err != nil {
+		resp.Body.Close()
+		var (
+			serr *StatusError
+			derr *DecodeError
+		)
+		switch {
+		case errors.As(err, &serr):
+			serr.Front = front
+			serr.Host = host
+		case errors.As(err, &derr):
+			derr.Front = front
+			derr.Host = host
+		}
+		return nil, contextError(ctx, err)
+	}
+	dcfg := &ampcodec.DecoderConfig{
+		Carrier: c.Carrier,
+		Marker:  c.Marker,
+		MaxSize: c.MaxResponseSize,
+		Framed:  c.Framed,
 	}
-	data, err := ampcodec.NewDecoder(resp.Body)
+	dec, err := dcfg.NewDecoder(resp.Body)
 	if err != nil {
+		resp.Body.Close()
+		return nil, contextError(ctx, &DecodeError{Front: front, Host: host, Err: err})
+	}
+	body := &responseBody{
+		ctx:           ctx,
+		dec:           dec,
+		body:          resp.Body,
+		front:         front,
+		host:          host,
+		requireStatus: c.RequireStatus,
+	}
+	// The status of short replies is known right away.
+	if err := body.statusError(); err != nil {
+		resp.Body.Close()
 		return nil, err
 	}
-	return data, nil
+	return body, nil
+}
+
+// responseBody streams the reply data out of the page.
+type responseBody struct {
+	ctx   context.Context
+	dec   *ampcodec.Decoder
+	body  io.ReadCloser
+	front string
+	host  string
+	// requireStatus makes a missing status an error at EOF.
+	requireStatus bool
+}
+
+// statusError returns the error for the status of the page.
+func (b *responseBody) statusError() error {
+	st := b.dec.Status()
+	// Older servers do not send status.
+	if st == nil || (st.Code >= 200 && st.Code <= 299) {
+		return nil
+	}
+	return &ServerError{
+		StatusCode: st.Code,
+		Message:    st.Message,
+		Front:      b.front,
+		Host:       b.host,
+	}
+}
+
+func (b *responseBody) Read(p []byte) (int, error) {
+	n, err := b.dec.Read(p)
+	switch {
+	case err == io.EOF:
+		if b.requireStatus && b.dec.Status() == nil {
+			return n, contextError(b.ctx, &DecodeError{Front: b.front, Host: b.host, Err: ErrNoStatus})
+		}
+		if serr := b.statusError(); serr != nil {
+			return n, serr
+		}
+	case err != nil:
+		err = contextError(b.ctx, &DecodeError{Front: b.front, Host: b.host, Err: err})
+	}
+	return n, err
+}
+
+func (b *responseBody) Close() error {
+	return b.body.Close()
 }
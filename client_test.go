@@ -0,0 +1,302 @@
+package amper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	ampcodec "github.com/unkaktus/amper/codec/amp"
+	getcodec "github.com/unkaktus/amper/codec/get"
+)
+
+func echoHandler() Handler {
+	return HandlerFunc(func(w io.Writer, r io.Reader) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+// newTestClient starts a Server with handler h and returns
+// a non-fronted plain HTTP Client pointing to it.
+func newTestClient(t *testing.T, h Handler) *Client {
+	ts := httptest.NewServer(&Server{Handler: h})
+	t.Cleanup(ts.Close)
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Client{
+		Host:       u.Host,
+		Scheme:     "http",
+		BytesRange: "0-",
+	}
+}
+
+func TestRoundTripContext(t *testing.T) {
+	is := is.New(t)
+	c := newTestClient(t, echoHandler())
+	input := []byte("hello, amper")
+	resp, err := c.RoundTripContext(context.Background(), bytes.NewReader(input))
+	is.NoErr(err)
+	output, err := io.ReadAll(resp)
+	is.NoErr(err)
+	is.Equal(output, input)
+}
+
+func TestRoundTripContextDeadline(t *testing.T) {
+	is := is.New(t)
+	release := make(chan struct{})
+	defer close(release)
+	c := newTestClient(t, HandlerFunc(func(w io.Writer, r io.Reader) error {
+		<-release
+		return nil
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := c.RoundTripContext(ctx, bytes.NewReader([]byte("x")))
+	var cerr *CanceledError
+	is.True(errors.As(err, &cerr))
+	is.True(errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestRoundTripContextCanceled(t *testing.T) {
+	is := is.New(t)
+	c := newTestClient(t, echoHandler())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.RoundTripContext(ctx, bytes.NewReader([]byte("x")))
+	is.True(errors.Is(err, context.Canceled))
+}
+
+func TestRoundTripFragmented(t *testing.T) {
+	is := is.New(t)
+	for _, enc := range []*getcodec.EncoderConfig{
+		nil,
+		{Buckets: []int{128}, SegmentLength: 32},
+		{Styles: []getcodec.PathStyle{getcodec.NewsStyle{}, getcodec.CategoryStyle{}}},
+		{Compress: true},
+	} {
+		c := newTestClient(t, echoHandler())
+		c.MaxFragmentSize = 100
+		c.PathEncoder = enc
+		input := bytes.Repeat([]byte("0123456789"), 105)
+		resp, err := c.RoundTrip(bytes.NewReader(input))
+		is.NoErr(err)
+		output, err := io.ReadAll(resp)
+		is.NoErr(err)
+		is.Equal(output, input)
+	}
+}
+
+type transportFunc func(r *http.Request) (*http.Response, error)
+
+func (f transportFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestRoundTripErrors(t *testing.T) {
+	is := is.New(t)
+	c := &Client{
+		Host:  "amp.example.org",
+		Front: "www.google.com",
+	}
+
+	c.Transport = transportFunc(func(r *http.Request) (*http.Response, error) {
+		w := httptest.NewRecorder()
+		http.Error(w, strings.Repeat("forbidden", 100), http.StatusForbidden)
+		return w.Result(), nil
+	})
+	_, err := c.RoundTrip(bytes.NewReader(nil))
+	var serr *StatusError
+	is.True(errors.As(err, &serr))
+	is.Equal(serr.StatusCode, http.StatusForbidden)
+	is.Equal(serr.Front, "www.google.com")
+	is.Equal(serr.Host, "amp-example-org.cdn.ampproject.org")
+	is.Equal(len(serr.Body), maxErrorBodySize)
+
+	c.Transport = transportFunc(func(r *http.Request) (*http.Response, error) {
+		w := httptest.NewRecorder()
+		io.WriteString(w, "<html><body>not amper</body></html>")
+		return w.Result(), nil
+	})
+	_, err = c.RoundTrip(bytes.NewReader(nil))
+	var derr *DecodeError
+	is.True(errors.As(err, &derr))
+	is.True(errors.Is(err, ampcodec.ErrNoDataElement))
+
+	blocked := errors.New("connection reset")
+	c.Transport = transportFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, blocked
+	})
+	_, err = c.RoundTrip(bytes.NewReader(nil))
+	var terr *TransportError
+	is.True(errors.As(err, &terr))
+	is.True(errors.Is(err, blocked))
+
+	c.Scheme = "ftp"
+	_, err = c.RoundTrip(bytes.NewReader(nil))
+	is.True(errors.Is(err, ErrUnsupportedScheme))
+}
+
+func TestRequireStatus(t *testing.T) {
+	is := is.New(t)
+	server := &Server{Handler: echoHandler()}
+	// Older servers send pages without status.
+	noStatus := regexp.MustCompile(`<pre id="status">[^<]*</pre>`)
+	c := &Client{
+		Host:  "amp.example.org",
+		Front: "www.google.com",
+		Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+			page := httptest.NewRecorder()
+			server.ServeHTTP(page, r)
+			w := httptest.NewRecorder()
+			w.Write(noStatus.ReplaceAll(page.Body.Bytes(), nil))
+			return w.Result(), nil
+		}),
+	}
+	resp, err := c.RoundTrip(bytes.NewReader([]byte("hello")))
+	is.NoErr(err)
+	output, err := io.ReadAll(resp)
+	is.NoErr(err)
+	is.Equal(string(output), "hello")
+
+	c.RequireStatus = true
+	resp, err = c.RoundTrip(bytes.NewReader([]byte("hello")))
+	is.NoErr(err)
+	_, err = io.ReadAll(resp)
+	var derr *DecodeError
+	is.True(errors.As(err, &derr))
+	is.True(errors.Is(err, ErrNoStatus))
+
+	// Pages of the server always carry status.
+	c = newTestClient(t, echoHandler())
+	c.RequireStatus = true
+	resp, err = c.RoundTrip(bytes.NewReader([]byte("hello")))
+	is.NoErr(err)
+	output, err = io.ReadAll(resp)
+	is.NoErr(err)
+	is.Equal(string(output), "hello")
+}
+
+func TestRoundTripStreaming(t *testing.T) {
+	is := is.New(t)
+	proceed := make(chan struct{})
+	ts := httptest.NewServer(&Server{
+		FlushOnWrite: true,
+		Handler: HandlerFunc(func(w io.Writer, r io.Reader) error {
+			w.Write([]byte("abc"))
+			<-proceed
+			w.Write([]byte("def"))
+			return errors.New("handler failed")
+		}),
+	})
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	is.NoErr(err)
+	c := &Client{Host: u.Host, Scheme: "http", BytesRange: "0-"}
+
+	resp, err := c.RoundTrip(bytes.NewReader(nil))
+	is.NoErr(err)
+	defer resp.Close()
+	// The reply is read before the handler returns.
+	buf := make([]byte, 16)
+	n, err := resp.Read(buf)
+	is.NoErr(err)
+	is.Equal(string(buf[:n]), "abc")
+	close(proceed)
+	rest, err := io.ReadAll(resp)
+	is.Equal(string(rest), "def")
+	// The status comes at the end of the reply.
+	var serr *ServerError
+	is.True(errors.As(err, &serr))
+	is.Equal(serr.StatusCode, http.StatusInternalServerError)
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	is := is.New(t)
+	c := newTestClient(t, echoHandler())
+	c.MaxResponseSize = 100
+	resp, err := c.RoundTrip(bytes.NewReader(make([]byte, 100)))
+	is.NoErr(err)
+	_, err = io.ReadAll(resp)
+	is.NoErr(err)
+
+	resp, err = c.RoundTrip(bytes.NewReader(make([]byte, 1000)))
+	if err == nil {
+		_, err = io.ReadAll(resp)
+	}
+	var derr *DecodeError
+	is.True(errors.As(err, &derr))
+	is.True(errors.Is(err, ampcodec.ErrTooLarge))
+}
+
+func TestRoundTripCarrier(t *testing.T) {
+	is := is.New(t)
+	carrier := ampcodec.AttributeCarrier{ChunkSize: 64}
+	marker := ampcodec.SecretMarker{Secret: []byte("secret")}
+	ts := httptest.NewServer(&Server{
+		Handler:  echoHandler(),
+		Carrier:  carrier,
+		Template: ampcodec.RandomTemplates{},
+		Marker:   marker,
+	})
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	is.NoErr(err)
+	c := &Client{
+		Host:       u.Host,
+		Scheme:     "http",
+		BytesRange: "0-",
+		Carrier:    carrier,
+		Marker:     marker,
+	}
+	input := bytes.Repeat([]byte("amper"), 100)
+	resp, err := c.RoundTrip(bytes.NewReader(input))
+	is.NoErr(err)
+	defer resp.Close()
+	output, err := io.ReadAll(resp)
+	is.NoErr(err)
+	is.Equal(output, input)
+}
+
+func TestRoundTripFramed(t *testing.T) {
+	is := is.New(t)
+	ts := httptest.NewServer(&Server{
+		Handler:  echoHandler(),
+		Framed:   true,
+		Encoding: ampcodec.Base85,
+		Compress: true,
+	})
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	is.NoErr(err)
+	c := &Client{
+		Host:       u.Host,
+		Scheme:     "http",
+		BytesRange: "0-",
+		Framed:     true,
+	}
+	input := bytes.Repeat([]byte("amper"), 100)
+	resp, err := c.RoundTrip(bytes.NewReader(input))
+	is.NoErr(err)
+	defer resp.Close()
+	output, err := io.ReadAll(resp)
+	is.NoErr(err)
+	is.Equal(output, input)
+
+	// Clients which do not expect framing fail clearly.
+	c.Framed = false
+	_, err = c.RoundTrip(bytes.NewReader(input))
+	var derr *DecodeError
+	is.True(errors.As(err, &derr))
+	is.True(errors.Is(err, ampcodec.ErrFraming))
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"io"
 	"time"
@@ -11,15 +12,22 @@ import (
 	"github.com/unkaktus/amper"
 )
 
+// pingTimeout bounds a single ping so that stalled requests
+// do not pile up.
+const pingTimeout = 30 * time.Second
+
 func ping(c *amper.Client) {
 	req := &bytes.Buffer{}
 	io.CopyN(req, rand.Reader, 1550)
 	reqData := req.Bytes()
 
-	resp, err := c.RoundTrip(req)
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	resp, err := c.RoundTripContext(ctx, req)
 	if err != nil {
 		log.Fatal().Err(err).Msg("perform round trip")
 	}
+	defer resp.Close()
 
 	respData, err := io.ReadAll(resp)
 	if err != nil {
@@ -32,8 +40,9 @@ func ping(c *amper.Client) {
 
 func main() {
 	c := &amper.Client{
-		Host:  "amp.unkaktus.art",
-		Front: "www.google.com",
+		Host:          "amp.unkaktus.art",
+		Front:         "www.google.com",
+		RequireStatus: true,
 	}
 
 	ticker := time.NewTicker(1 * time.Second)
@@ -2,12 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"flag"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
@@ -15,15 +17,16 @@ import (
 	"github.com/unkaktus/amper"
 )
 
-func ping(c *amper.Client, payloadSize int64) error {
+func ping(ctx context.Context, c *amper.Client, payloadSize int64) error {
 	req := &bytes.Buffer{}
 	io.CopyN(req, rand.Reader, payloadSize)
 	reqData := req.Bytes()
 
-	resp, err := c.RoundTrip(req)
+	resp, err := c.RoundTripContext(ctx, req)
 	if err != nil {
 		return fmt.Errorf("perform round trip: %w", err)
 	}
+	defer resp.Close()
 
 	respData, err := io.ReadAll(resp)
 	if err != nil {
@@ -93,14 +96,16 @@ var statusBadgeHandler http.Handler = http.HandlerFunc(func(w http.ResponseWrite
 func main() {
 	payloadSize := flag.Int64("payload-size", 1550, "size of echo payload")
 	host := flag.String("host", "amp.unkaktus.art", "AMP host (amper-server)")
-	front := flag.String("front", "www.google.com", "Fronting domain")
+	front := flag.String("front", "www.google.com", "Fronting domains, comma-separated in the order of preference")
 	interval := flag.Duration("interval", time.Second, "Ping interval")
+	timeout := flag.Duration("timeout", 30*time.Second, "Ping timeout")
 	listenAddress := flag.String("l", ":http", "Address to listen on, in format hostname:port")
 	flag.Parse()
 
 	c := &amper.Client{
-		Host:  *host,
-		Front: *front,
+		Host:          *host,
+		FrontPool:     amper.NewFrontPool(strings.Split(*front, ",")...),
+		RequireStatus: true,
 	}
 
 	status.AmperHost = *host
@@ -111,7 +116,9 @@ func main() {
 	go func() {
 		for {
 			start := time.Now()
-			err := ping(c, *payloadSize)
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			err := ping(ctx, c, *payloadSize)
+			cancel()
 			rtt := time.Since(start)
 			log.Info().Str("rtt", rtt.String()).Msg("got response")
 			if err != nil {
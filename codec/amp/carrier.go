@@ -0,0 +1,271 @@
+// carrier.go - ways to carry payload in AMP pages.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of amper, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package ampcodec
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+// DefaultChunkSize is the default length of the payload text
+// carried by a single element.
+const DefaultChunkSize = 1024
+
+// preLineLength is the length of the lines of payload text in pre.
+const preLineLength = 32
+
+// Carrier defines how the text of the payload is embedded
+// into a page. Encoder and Decoder have to use the same Carrier.
+// The elements carrying payload are marked with the IDs of Marker,
+// and the ones it repeats get the index of the chunk appended.
+// Carriers are stateless, so that they can be shared by encoders.
+type Carrier interface {
+	// Head writes the markup the carrier needs in the page head,
+	// e.g. scripts of AMP extensions.
+	Head(w io.Writer) error
+	// Open writes the markup which precedes the payload.
+	Open(w io.Writer, m Marker) error
+	// WriteChunk writes a chunk of the payload text.
+	WriteChunk(w io.Writer, m Marker, chunk []byte) error
+	// Close writes the markup which follows the payload.
+	Close(w io.Writer, m Marker) error
+	// MaxChunkSize returns the maximum length of chunks passed
+	// to WriteChunk. Shorter chunks are written on flushes
+	// and at the end of the payload.
+	MaxChunkSize() int
+	// PayloadAttr returns the attribute which carries payload in
+	// the marked element starting with token t. An empty attribute
+	// means that the payload is the text inside the element.
+	PayloadAttr(t html.Token) string
+	// Extract returns the payload text out of the text
+	// carrying it.
+	Extract(text []byte) []byte
+}
+
+func attribute(t html.Token, key string) (string, bool) {
+	for _, a := range t.Attr {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+func chunkSize(n int) int {
+	if n != 0 {
+		return n
+	}
+	return DefaultChunkSize
+}
+
+// PreCarrier carries payload as the text of a single
+// pre element. It is the default carrier.
+type PreCarrier struct{}
+
+func (PreCarrier) Head(w io.Writer) error {
+	return nil
+}
+
+func (PreCarrier) Open(w io.Writer, m Marker) error {
+	_, err := fmt.Fprintf(w, `<pre id="%s">`, m.ID(RoleData))
+	return err
+}
+
+func (PreCarrier) WriteChunk(w io.Writer, m Marker, chunk []byte) error {
+	if _, err := w.Write(chunk); err != nil {
+		return err
+	}
+	// Break the text so that it looks less like a blob.
+	// Lines may be shorter not to split multibyte characters.
+	if len(chunk) > preLineLength-utf8.UTFMax {
+		_, err := io.WriteString(w, " ")
+		return err
+	}
+	return nil
+}
+
+func (PreCarrier) Close(w io.Writer, m Marker) error {
+	_, err := io.WriteString(w, `</pre>`)
+	return err
+}
+
+func (PreCarrier) MaxChunkSize() int {
+	return preLineLength
+}
+
+func (PreCarrier) PayloadAttr(t html.Token) string {
+	return ""
+}
+
+func (PreCarrier) Extract(text []byte) []byte {
+	return text
+}
+
+// MultiElementCarrier spreads payload over a series of elements,
+// carrying a chunk of it as the text of each element.
+type MultiElementCarrier struct {
+	// Tag is the name of the elements. Defaults to "p".
+	Tag string
+	// ChunkSize is the length of the text of an element.
+	// Defaults to DefaultChunkSize.
+	ChunkSize int
+}
+
+func (c MultiElementCarrier) tag() string {
+	if c.Tag != "" {
+		return c.Tag
+	}
+	return "p"
+}
+
+func (c MultiElementCarrier) Head(w io.Writer) error {
+	return nil
+}
+
+func (c MultiElementCarrier) Open(w io.Writer, m Marker) error {
+	return nil
+}
+
+func (c MultiElementCarrier) WriteChunk(w io.Writer, m Marker, chunk []byte) error {
+	_, err := fmt.Fprintf(w, "<%s id=\"%s\">%s</%s>\n    ", c.tag(), m.ID(RoleData), chunk, c.tag())
+	return err
+}
+
+func (c MultiElementCarrier) Close(w io.Writer, m Marker) error {
+	return nil
+}
+
+func (c MultiElementCarrier) MaxChunkSize() int {
+	return chunkSize(c.ChunkSize)
+}
+
+func (c MultiElementCarrier) PayloadAttr(t html.Token) string {
+	return ""
+}
+
+func (c MultiElementCarrier) Extract(text []byte) []byte {
+	return text
+}
+
+// JSONCarrier carries payload as an array of strings
+// in the JSON script of an amp-state element.
+type JSONCarrier struct {
+	// ChunkSize is the length of the strings in the array.
+	// Defaults to DefaultChunkSize.
+	ChunkSize int
+}
+
+func (c JSONCarrier) Head(w io.Writer) error {
+	_, err := io.WriteString(w, `<script async custom-element="amp-bind" src="https://cdn.ampproject.org/v0/amp-bind-0.1.js"></script>`)
+	return err
+}
+
+func (c JSONCarrier) Open(w io.Writer, m Marker) error {
+	// The array starts with an empty string, so that
+	// every chunk is preceded by a comma.
+	_, err := fmt.Fprintf(w, `<amp-state id="%s"><script type="application/json">[""`, m.ID(RoleData))
+	return err
+}
+
+func (c JSONCarrier) WriteChunk(w io.Writer, m Marker, chunk []byte) error {
+	_, err := fmt.Fprintf(w, `,"%s"`, chunk)
+	return err
+}
+
+func (c JSONCarrier) Close(w io.Writer, m Marker) error {
+	_, err := io.WriteString(w, `]</script></amp-state>`)
+	return err
+}
+
+func (c JSONCarrier) MaxChunkSize() int {
+	return chunkSize(c.ChunkSize)
+}
+
+func (c JSONCarrier) PayloadAttr(t html.Token) string {
+	return ""
+}
+
+func (c JSONCarrier) Extract(text []byte) []byte {
+	return bytes.Map(func(r rune) rune {
+		switch r {
+		case '[', ']', '"', ',':
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// AttributeCarrier spreads payload over a series of elements,
+// carrying a chunk of it in an attribute of each element.
+type AttributeCarrier struct {
+	// Tag is the name of the elements. Defaults to "amp-img".
+	Tag string
+	// Attr is the attribute carrying the payload,
+	// e.g. a data-* attribute. Defaults to "alt".
+	Attr string
+	// Attrs are the other attributes of the elements. If Tag
+	// is not set, they default to the ones amp-img requires.
+	Attrs string
+	// ChunkSize is the length of the payload in an element.
+	// Defaults to DefaultChunkSize.
+	ChunkSize int
+}
+
+func (c AttributeCarrier) tag() string {
+	if c.Tag != "" {
+		return c.Tag
+	}
+	return "amp-img"
+}
+
+func (c AttributeCarrier) attr() string {
+	if c.Attr != "" {
+		return c.Attr
+	}
+	return "alt"
+}
+
+func (c AttributeCarrier) attrs() string {
+	if c.Tag == "" && c.Attrs == "" {
+		return `src="/pixel.png" width="1" height="1" layout="fixed"`
+	}
+	return c.Attrs
+}
+
+func (c AttributeCarrier) Head(w io.Writer) error {
+	return nil
+}
+
+func (c AttributeCarrier) Open(w io.Writer, m Marker) error {
+	return nil
+}
+
+func (c AttributeCarrier) WriteChunk(w io.Writer, m Marker, chunk []byte) error {
+	_, err := fmt.Fprintf(w, "<%s id=\"%s\" %s=\"%s\" %s></%s>\n    ", c.tag(), m.ID(RoleData), c.attr(), chunk, c.attrs(), c.tag())
+	return err
+}
+
+func (c AttributeCarrier) Close(w io.Writer, m Marker) error {
+	return nil
+}
+
+func (c AttributeCarrier) MaxChunkSize() int {
+	return chunkSize(c.ChunkSize)
+}
+
+func (c AttributeCarrier) PayloadAttr(t html.Token) string {
+	return c.attr()
+}
+
+func (c AttributeCarrier) Extract(text []byte) []byte {
+	return text
+}
@@ -0,0 +1,467 @@
+package ampcodec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"unicode/utf8"
+
+	"github.com/matryer/is"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	is := is.New(t)
+	input := bytes.Repeat([]byte("amper"), 100)
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	_, err := enc.Write(input)
+	is.NoErr(err)
+	is.NoErr(enc.Close())
+
+	r, st, err := Decode(buf)
+	is.NoErr(err)
+	is.Equal(*st, Status{Code: StatusOK})
+	output, err := io.ReadAll(r)
+	is.NoErr(err)
+	is.Equal(output, input)
+}
+
+func TestStatus(t *testing.T) {
+	is := is.New(t)
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	is.NoErr(enc.CloseWithStatus(500, "<broken> & failed"))
+	is.Equal(enc.Close(), ErrEncoderClosed)
+
+	r, st, err := Decode(buf)
+	is.NoErr(err)
+	is.Equal(*st, Status{Code: 500, Message: "<broken> & failed"})
+	output, err := io.ReadAll(r)
+	is.NoErr(err)
+	is.Equal(len(output), 0)
+
+	// Long messages are cut between characters.
+	buf.Reset()
+	enc = NewEncoder(buf)
+	is.NoErr(enc.CloseWithStatus(500, strings.Repeat("é", 200)))
+	is.True(utf8.Valid(buf.Bytes()))
+	_, st, err = Decode(buf)
+	is.NoErr(err)
+	is.Equal(st.Message, strings.Repeat("é", maxStatusMessageLength/2))
+}
+
+func TestDecodeLegacy(t *testing.T) {
+	is := is.New(t)
+	page := `<html><body><pre id="data">YW1w ZXI</pre></body></html>`
+	r, st, err := Decode(bytes.NewReader([]byte(page)))
+	is.NoErr(err)
+	is.True(st == nil)
+	output, err := io.ReadAll(r)
+	is.NoErr(err)
+	is.Equal(string(output), "amper")
+
+	_, _, err = Decode(bytes.NewReader([]byte(`<html><pre id="status">x</pre></html>`)))
+	is.Equal(err, ErrMalformedStatus)
+}
+
+type flushBuffer struct {
+	bytes.Buffer
+	flushes int
+}
+
+func (fb *flushBuffer) Flush() {
+	fb.flushes++
+}
+
+func TestEncoderFlush(t *testing.T) {
+	is := is.New(t)
+	buf := &flushBuffer{}
+	enc := NewEncoder(buf)
+	is.NoErr(enc.Flush())
+	is.Equal(buf.flushes, 1)
+	header := buf.Len()
+
+	_, err := enc.Write([]byte("amper"))
+	is.NoErr(err)
+	is.NoErr(enc.Flush())
+	is.Equal(buf.flushes, 2)
+	// The complete quantum is flushed, the last two bytes are held.
+	is.Equal(string(buf.Bytes()[header:]), "YW1w")
+
+	is.NoErr(enc.Close())
+	is.Equal(enc.Flush(), ErrEncoderClosed)
+}
+
+func TestDecoderStreaming(t *testing.T) {
+	is := is.New(t)
+	pr, pw := io.Pipe()
+	enc := NewEncoder(pw)
+	flushed := make(chan struct{})
+	go func() {
+		enc.Write([]byte("first"))
+		enc.Flush()
+		close(flushed)
+	}()
+	dec, err := (&DecoderConfig{}).NewDecoder(pr)
+	is.NoErr(err)
+	// The first chunk is decoded before the page is complete.
+	b := make([]byte, 16)
+	n, err := dec.Read(b)
+	is.NoErr(err)
+	is.Equal(string(b[:n]), "fir")
+	is.True(dec.Status() == nil)
+
+	<-flushed
+	go func() {
+		enc.Write([]byte("second"))
+		enc.CloseWithStatus(202, "partial")
+		pw.Close()
+	}()
+	rest, err := io.ReadAll(dec)
+	is.NoErr(err)
+	is.Equal(string(b[:n])+string(rest), "firstsecond")
+	is.Equal(*dec.Status(), Status{Code: 202, Message: "partial"})
+}
+
+func TestDecoderLimit(t *testing.T) {
+	is := is.New(t)
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	_, err := enc.Write(bytes.Repeat([]byte("a"), 1000))
+	is.NoErr(err)
+	is.NoErr(enc.Close())
+	page := buf.Bytes()
+
+	dec, err := NewLimitedDecoder(bytes.NewReader(page), 1000)
+	is.NoErr(err)
+	output, err := io.ReadAll(dec)
+	is.NoErr(err)
+	is.Equal(len(output), 1000)
+
+	dec, err = NewLimitedDecoder(bytes.NewReader(page), 999)
+	if err == nil {
+		_, err = io.ReadAll(dec)
+	}
+	is.Equal(err, ErrTooLarge)
+}
+
+func TestDecoderMalformed(t *testing.T) {
+	is := is.New(t)
+	_, err := NewDecoder(bytes.NewReader([]byte(`<pre id="data">YW1w*ZXI</pre>`)))
+	is.True(errors.Is(err, ErrMalformedPayload))
+
+	_, err = NewDecoder(bytes.NewReader([]byte(`<pre id="other">YW1w</pre>`)))
+	is.Equal(err, ErrNoDataElement)
+
+	// A truncated page yields what it has.
+	dec, err := (&DecoderConfig{}).NewDecoder(bytes.NewReader([]byte(`<pre id="data">YW1wZXI`)))
+	is.NoErr(err)
+	output, err := io.ReadAll(dec)
+	is.NoErr(err)
+	is.Equal(string(output), "amper")
+	is.True(dec.Status() == nil)
+}
+
+func TestCarriers(t *testing.T) {
+	carriers := map[string]Carrier{
+		"pre":       PreCarrier{},
+		"multi":     MultiElementCarrier{ChunkSize: 100},
+		"json":      JSONCarrier{ChunkSize: 100},
+		"attribute": AttributeCarrier{ChunkSize: 100},
+		"data-attr": AttributeCarrier{Tag: "div", Attr: "data-v", ChunkSize: 7},
+	}
+	input := bytes.Repeat([]byte("amper"), 100)
+	for name, carrier := range carriers {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			buf := &bytes.Buffer{}
+			enc := NewEncoder(buf)
+			enc.Carrier = carrier
+			_, err := enc.Write(input[:10])
+			is.NoErr(err)
+			is.NoErr(enc.Flush())
+			_, err = enc.Write(input[10:])
+			is.NoErr(err)
+			is.NoErr(enc.CloseWithStatus(201, "created"))
+
+			cfg := &DecoderConfig{Carrier: carrier}
+			dec, err := cfg.NewDecoder(bytes.NewReader(buf.Bytes()))
+			is.NoErr(err)
+			output, err := io.ReadAll(dec)
+			is.NoErr(err)
+			is.Equal(output, input)
+			is.Equal(*dec.Status(), Status{Code: 201, Message: "created"})
+
+			// Every element has its own ID.
+			ids := map[string]bool{}
+			for _, m := range regexp.MustCompile(` id="([^"]*)"`).FindAllStringSubmatch(buf.String(), -1) {
+				is.True(!ids[m[1]])
+				ids[m[1]] = true
+			}
+
+			// Pages without payload are fine too.
+			buf.Reset()
+			enc = NewEncoder(buf)
+			enc.Carrier = carrier
+			is.NoErr(enc.Close())
+			dec, err = cfg.NewDecoder(bytes.NewReader(buf.Bytes()))
+			is.NoErr(err)
+			output, err = io.ReadAll(dec)
+			is.NoErr(err)
+			is.Equal(len(output), 0)
+		})
+	}
+}
+
+func TestSecretMarker(t *testing.T) {
+	is := is.New(t)
+	m := SecretMarker{Secret: []byte("secret")}
+	id := m.ID(RoleData)
+	is.True(id != m.ID(RoleData))
+	is.Equal(m.Role(id), RoleData)
+	is.Equal(m.Role(m.ID(RoleStatus)), RoleStatus)
+	is.Equal(SecretMarker{Secret: []byte("other")}.Role(id), "")
+	is.Equal(m.Role("data"), "")
+	is.Equal(m.Role("section-xyz"), "")
+}
+
+func TestTemplates(t *testing.T) {
+	is := is.New(t)
+	marker := SecretMarker{Secret: []byte("secret")}
+	input := bytes.Repeat([]byte("amper"), 100)
+	carriers := []Carrier{PreCarrier{}, MultiElementCarrier{}, JSONCarrier{}, AttributeCarrier{ChunkSize: 100}}
+	pages := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		carrier := carriers[i%len(carriers)]
+		buf := &bytes.Buffer{}
+		enc := NewEncoder(buf)
+		enc.Carrier = carrier
+		enc.Template = RandomTemplates{}
+		enc.Marker = marker
+		_, err := enc.Write(input)
+		is.NoErr(err)
+		is.NoErr(enc.Close())
+		page := buf.String()
+		is.True(!strings.Contains(page, DefaultTemplate.Header))
+		is.True(!strings.Contains(page, `id="data"`))
+		pages[page] = true
+
+		dec, err := (&DecoderConfig{Carrier: carrier, Marker: marker}).NewDecoder(strings.NewReader(page))
+		is.NoErr(err)
+		output, err := io.ReadAll(dec)
+		is.NoErr(err)
+		is.Equal(output, input)
+		is.Equal(*dec.Status(), Status{Code: StatusOK})
+
+		// The payload is not found without the secret.
+		_, err = (&DecoderConfig{Carrier: carrier}).NewDecoder(strings.NewReader(page))
+		is.Equal(err, ErrNoDataElement)
+	}
+	is.Equal(len(pages), 20)
+}
+
+// TestTransformedPages decodes the pages in testdata/transformed,
+// which imitate the transformations AMP caches apply to pages.
+func TestTransformedPages(t *testing.T) {
+	payload := "The quick brown fox jumps over the lazy dog? <>~~~ amper"
+	ok := &Status{Code: StatusOK}
+	for _, tc := range []struct {
+		file    string
+		carrier Carrier
+		status  *Status
+	}{
+		{"google_cache.html", nil, ok},
+		{"reordered_attributes.html", nil, ok},
+		{"uppercase_tags.html", nil, &Status{Code: StatusOK, Message: "OK"}},
+		{"entities.html", nil, &Status{Code: 404, Message: "not & found <here>"}},
+		{"split_text.html", nil, &Status{Code: StatusOK, Message: "done"}},
+		{"whitespace.html", nil, &Status{Code: 500, Message: "internal error"}},
+		{"injected_elements.html", nil, ok},
+		{"attribute_carrier.html", AttributeCarrier{}, ok},
+		{"json_carrier.html", JSONCarrier{}, ok},
+		{"multi_element_carrier.html", MultiElementCarrier{}, ok},
+		{"truncated.html", nil, nil},
+	} {
+		t.Run(tc.file, func(t *testing.T) {
+			is := is.New(t)
+			page, err := os.ReadFile(filepath.Join("testdata", "transformed", tc.file))
+			is.NoErr(err)
+			// Reading byte by byte splits the page at every point.
+			for _, r := range []io.Reader{bytes.NewReader(page), iotest.OneByteReader(bytes.NewReader(page))} {
+				dec, err := (&DecoderConfig{Carrier: tc.carrier}).NewDecoder(r)
+				is.NoErr(err)
+				output, err := io.ReadAll(dec)
+				is.NoErr(err)
+				is.Equal(string(output), payload)
+				is.Equal(dec.Status(), tc.status)
+			}
+		})
+	}
+}
+
+func TestFramed(t *testing.T) {
+	is := is.New(t)
+	encode := func(payload []byte) string {
+		buf := &bytes.Buffer{}
+		enc := NewEncoder(buf)
+		enc.Framed = true
+		if len(payload) != 0 {
+			_, err := enc.Write(payload[:10])
+			is.NoErr(err)
+			_, err = enc.Write(payload[10:])
+			is.NoErr(err)
+		}
+		is.NoErr(enc.Close())
+		return buf.String()
+	}
+	decode := func(page string) ([]byte, error) {
+		dec, err := (&DecoderConfig{Framed: true}).NewDecoder(strings.NewReader(page))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(dec)
+	}
+	input := bytes.Repeat([]byte("amper"), 100)
+	page := encode(input)
+	output, err := decode(page)
+	is.NoErr(err)
+	is.Equal(output, input)
+
+	output, err = decode(encode(nil))
+	is.NoErr(err)
+	is.Equal(len(output), 0)
+
+	// Cut short, as by a CDN.
+	start := strings.Index(page, `<pre id="data">`) + len(`<pre id="data">`)
+	end := strings.Index(page, `</pre>`)
+	_, err = decode(page[:start+100])
+	is.Equal(err, ErrTruncated)
+	// Cut short with the status still in place.
+	_, err = decode(page[:start] + page[start:end-20] + page[end:])
+	is.Equal(err, ErrTruncated)
+
+	// Corrupted in the middle of the payload.
+	i := start + 200
+	c := "A"
+	if page[i] == 'A' {
+		c = "B"
+	}
+	_, err = decode(page[:i] + c + page[i+1:])
+	is.Equal(err, ErrChecksum)
+
+	// Unframed payload is not accepted.
+	_, err = decode(`<pre id="data">YW1wZXI</pre>`)
+	is.True(errors.Is(err, ErrFraming))
+	// Neither is framed payload by unframed decoders.
+	_, err = NewDecoder(strings.NewReader(page))
+	is.True(errors.Is(err, ErrFraming))
+}
+
+func TestPadding(t *testing.T) {
+	is := is.New(t)
+	encode := func(payload []byte, padding Padding) string {
+		buf := &bytes.Buffer{}
+		enc := NewEncoder(buf)
+		enc.Padding = padding
+		_, err := enc.Write(payload)
+		is.NoErr(err)
+		is.NoErr(enc.Close())
+		return buf.String()
+	}
+	decode := func(page string) []byte {
+		dec, err := (&DecoderConfig{Framed: true}).NewDecoder(strings.NewReader(page))
+		is.NoErr(err)
+		output, err := io.ReadAll(dec)
+		is.NoErr(err)
+		return output
+	}
+	sizes := map[int]bool{}
+	for _, n := range []int{0, 1, 10, 100, 126, 127, 128, 500, 1000} {
+		input := bytes.Repeat([]byte("a"), n)
+		page := encode(input, BucketPadding{})
+		is.Equal(decode(page), input)
+		sizes[len(page)] = true
+
+		page = encode(input, RandomPadding{Min: 10, Max: 1000})
+		is.Equal(decode(page), input)
+	}
+	is.Equal(len(sizes), 1) // all payloads fit the same bucket
+
+	// Frames are padded to the exact size.
+	frame := func(n int64, padding Padding) *bytes.Buffer {
+		buf := &bytes.Buffer{}
+		fw := newFrameWriter(buf, padding, false)
+		_, err := fw.Write(make([]byte, n))
+		is.NoErr(err)
+		is.NoErr(fw.Close())
+		return buf
+	}
+	for n := int64(0); n < 300; n++ {
+		size := int64(frame(n, nil).Len())
+		for _, pad := range []int64{0, 2, 3, 127, 128, 129, 130, 300} {
+			buf := frame(n, BucketPadding{Buckets: []int64{size + pad}})
+			is.Equal(int64(buf.Len()), size+pad)
+			output, err := io.ReadAll(newFrameReader(buf, 0))
+			is.NoErr(err)
+			is.Equal(int64(len(output)), n)
+		}
+	}
+
+	is.Equal(BucketPadding{}.Size(1), int64(DefaultMinBucket))
+	is.Equal(BucketPadding{}.Size(DefaultMinBucket+1), int64(2*DefaultMinBucket))
+	is.Equal(BucketPadding{Buckets: []int64{100, 1000}}.Size(101), int64(1000))
+	is.Equal(BucketPadding{Buckets: []int64{100, 1000}}.Size(1001), int64(2000))
+}
+
+func TestCompress(t *testing.T) {
+	is := is.New(t)
+	encode := func(compress bool, payload ...[]byte) []byte {
+		buf := &bytes.Buffer{}
+		enc := NewEncoder(buf)
+		enc.Compress = compress
+		for _, p := range payload {
+			_, err := enc.Write(p)
+			is.NoErr(err)
+			is.NoErr(enc.Flush())
+		}
+		is.NoErr(enc.Close())
+		return buf.Bytes()
+	}
+	decode := func(page []byte, maxSize int64) ([]byte, error) {
+		cfg := &DecoderConfig{Framed: true, MaxSize: maxSize}
+		dec, err := cfg.NewDecoder(iotest.OneByteReader(bytes.NewReader(page)))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(dec)
+	}
+	text := bytes.Repeat([]byte("In varietate concordia. "), 200)
+	random := make([]byte, 1000)
+	rand.Read(random)
+	page := encode(true, text, random, text[:10])
+	is.True(len(page) < len(encode(false, text, random, text[:10]))-len(text))
+	output, err := decode(page, 0)
+	is.NoErr(err)
+	is.Equal(output, append(append(append([]byte{}, text...), random...), text[:10]...))
+
+	// Decompressed payload is limited.
+	_, err = decode(page, int64(len(text)))
+	is.Equal(err, ErrTooLarge)
+
+	// Records decompressing beyond the limit of records are rejected.
+	buf := &bytes.Buffer{}
+	fw := newFrameWriter(buf, nil, true)
+	fw.compressor.Reset(&fw.compressed)
+	fw.compressor.Write(make([]byte, maxRecordSize+1))
+	fw.compressor.Close()
+	is.NoErr(fw.writeRecord(recordDeflate, fw.compressed.Bytes()))
+	_, err = io.ReadAll(newFrameReader(buf, 0))
+	is.True(errors.Is(err, ErrMalformedPayload))
+}
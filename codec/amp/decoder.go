@@ -9,68 +9,553 @@ package ampcodec
 
 import (
 	"bytes"
-	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
+	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/net/html"
 )
 
-func getAttribute(n *html.Node, key string) (string, bool) {
-	for _, attr := range n.Attr {
-		if attr.Key == key {
-			return attr.Val, true
-		}
-	}
-	return "", false
+var (
+	// ErrNoDataElement designates that the page has no element
+	// carrying the payload.
+	ErrNoDataElement = errors.New("no data element")
+	// ErrMalformedPayload designates that the payload
+	// could not be decoded.
+	ErrMalformedPayload = errors.New("malformed payload")
+	// ErrMalformedStatus designates that the status
+	// could not be decoded.
+	ErrMalformedStatus = errors.New("malformed status")
+	// ErrTooLarge designates that the payload exceeds
+	// the size limit of the Decoder.
+	ErrTooLarge = errors.New("payload is too large")
+)
+
+// Status is the in-band status of the reply carried by a page.
+type Status struct {
+	// Code is the status code, with the same meaning
+	// as HTTP status codes.
+	Code int
+	// Message is the status message.
+	Message string
 }
 
-func getNodeByID(n *html.Node, id string) *html.Node {
-	if n.Type == html.ElementNode {
-		s, ok := getAttribute(n, "id")
-		if ok && s == id {
-			return n
-		}
+// parseStatus parses the text of the status element.
+// Whitespace may be altered by AMP caches, so it is normalized.
+func parseStatus(s string) (*Status, error) {
+	code, message, _ := strings.Cut(strings.Join(strings.Fields(s), " "), " ")
+	st := &Status{Message: message}
+	var err error
+	st.Code, err = strconv.Atoi(code)
+	if err != nil {
+		return nil, ErrMalformedStatus
 	}
+	return st, nil
+}
 
-	for c := n.FirstChild; c != nil; c = c.NextSibling {
-		result := getNodeByID(c, id)
-		if result != nil {
-			return result
+func removeSpaces(b []byte) []byte {
+	return bytes.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
 		}
+		return r
+	}, b)
+}
+
+// maxEntityLength is the length of the longest character
+// reference which is held back until it is complete.
+const maxEntityLength = 32
+
+// pageReader is the reader of a page which allows
+// to put back the bytes read ahead.
+type pageReader struct {
+	buf []byte
+	r   io.Reader
+}
+
+func (pr *pageReader) Read(p []byte) (int, error) {
+	if len(pr.buf) != 0 {
+		n := copy(p, pr.buf)
+		pr.buf = pr.buf[n:]
+		return n, nil
 	}
-	return nil
+	return pr.r.Read(p)
+}
+
+// unread puts b back in front of the unread bytes.
+func (pr *pageReader) unread(b []byte) {
+	pr.buf = append(append([]byte{}, b...), pr.buf...)
+}
+
+// Decoder is a streaming decoder of AMP pages. It tokenizes
+// the page as it arrives instead of parsing the whole document,
+// and decodes the payload as soon as its text is read.
+// It tolerates the transformations of AMP caches: the payload
+// is the text of all descendants of the marked elements, with
+// character references and whitespace allowed anywhere, and
+// the text of injected scripts, styles and templates skipped.
+type Decoder struct {
+	pr      *pageReader
+	z       *html.Tokenizer
+	carrier Carrier
+	marker  Marker
+	maxSize int64
+	size    int64
+
+	// found is whether an element carrying payload was found.
+	found bool
+	// inText is whether the text of an element carrying payload
+	// is being read. tag is the name of the element, and depth
+	// counts elements of the same name nested into it.
+	inText bool
+	tag    string
+	depth  int
+	// text holds a character reference which is not complete yet.
+	text []byte
+	// quanta holds the payload text which is not decoded yet,
+	// and encoding is its encoding once its marker is read.
+	quanta   []byte
+	encoding *textEncoding
+	chunk    []byte
+	buf      []byte
+	status   *Status
+	err      error
+	framed   bool
+	frame    *frameReader
+}
+
+// DecoderConfig configures Decoder.
+type DecoderConfig struct {
+	// Carrier is the carrier of the payload in the page.
+	// If nil, PreCarrier is used.
+	Carrier Carrier
+	// Marker marks the elements carrying payload and status.
+	// If nil, FixedMarker is used.
+	Marker Marker
+	// MaxSize is the maximum size of the payload, above which
+	// decoding fails with ErrTooLarge. Zero means no limit.
+	MaxSize int64
+	// Framed makes the decoder expect the payload framed by
+	// Encoder with Framed, Padding or Compress set, and verify it.
+	// Payload cut short fails with ErrTruncated, and corrupted one
+	// with ErrChecksum. Compressed payload is decompressed.
+	// Payload framed or not unlike expected fails with ErrFraming.
+	Framed bool
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
 }
 
 // NewDecoder extracts payload from an AMP page body r.
+// Use DecoderConfig.NewDecoder to get the status of the page.
 func NewDecoder(r io.Reader) (io.ReadCloser, error) {
-	doc, err := html.Parse(r)
+	return NewLimitedDecoder(r, 0)
+}
+
+// NewLimitedDecoder is like NewDecoder, but the decoder fails
+// with ErrTooLarge once the payload exceeds maxSize bytes.
+// Zero maxSize means no limit.
+func NewLimitedDecoder(r io.Reader, maxSize int64) (io.ReadCloser, error) {
+	cfg := &DecoderConfig{MaxSize: maxSize}
+	d, err := cfg.NewDecoder(r)
 	if err != nil {
 		return nil, err
 	}
-	n := getNodeByID(doc, "data")
-	if n == nil {
-		err = errors.New("no element with this ID")
-		return nil, err
+	return d, nil
+}
+
+// NewDecoder extracts payload from an AMP page body r
+// according to cfg.
+func (cfg *DecoderConfig) NewDecoder(r io.Reader) (*Decoder, error) {
+	pr := &pageReader{r: r}
+	d := &Decoder{
+		pr:      pr,
+		carrier: cfg.Carrier,
+		marker:  cfg.Marker,
+		maxSize: cfg.MaxSize,
+		framed:  cfg.Framed,
 	}
-	// The node found but there is no child.
-	if n.FirstChild == nil {
-		return io.NopCloser(bytes.NewReader(nil)), nil
+	if d.carrier == nil {
+		d.carrier = PreCarrier{}
 	}
-	data := n.FirstChild.Data
-	// Remove all whitespaces
-	data = strings.Map(func(r rune) rune {
-		if unicode.IsSpace(r) {
-			return -1
+	if d.marker == nil {
+		d.marker = FixedMarker{}
+	}
+	// Decode the first chunk so that the errors of
+	// the page are reported right away.
+	for len(d.buf) == 0 && d.err == nil {
+		d.next()
+	}
+	if d.err != nil && d.err != io.EOF {
+		return nil, d.err
+	}
+	if !d.found {
+		return nil, ErrNoDataElement
+	}
+	if d.framed {
+		d.frame = newFrameReader(readerFunc(d.readPayload), d.maxSize)
+	}
+	return d, nil
+}
+
+// next processes the next piece of the page.
+func (d *Decoder) next() {
+	if d.inText {
+		d.nextText()
+		return
+	}
+	if d.z == nil {
+		d.z = html.NewTokenizer(d.pr)
+	}
+	tt := d.z.Next()
+	switch tt {
+	case html.ErrorToken:
+		if d.z.Err() != io.EOF {
+			d.err = d.z.Err()
+			return
 		}
-		return r
-	}, data)
-	b, err := base64.RawURLEncoding.DecodeString(data)
+		// Older servers do not send status.
+		d.finishData()
+		if d.err == nil {
+			d.err = io.EOF
+		}
+	case html.StartTagToken, html.SelfClosingTagToken:
+		t := d.z.Token()
+		id, ok := attribute(t, "id")
+		if !ok {
+			return
+		}
+		switch chunkRole(d.marker, id) {
+		case RoleStatus:
+			d.finishData()
+			if d.err == nil {
+				d.err = d.readStatus(t.Data, tt == html.SelfClosingTagToken)
+			}
+			// Carriers other than pre leave no trace
+			// of empty payload, so status marks the page.
+			d.found = d.found || d.status != nil
+			return
+		case RoleData:
+		default:
+			return
+		}
+		d.found = true
+		if attr := d.carrier.PayloadAttr(t); attr != "" {
+			val, _ := attribute(t, attr)
+			d.decode(d.carrier.Extract([]byte(val)))
+			return
+		}
+		if tt == html.StartTagToken {
+			// The text is scanned as it arrives, since the tokenizer
+			// returns text only once the next tag is read.
+			d.inText = true
+			d.tag = t.Data
+			d.depth = 0
+			d.pr.unread(d.z.Buffered())
+			d.z = nil
+		}
+	}
+}
+
+// nextText processes the next piece of the text
+// of an element carrying payload.
+func (d *Decoder) nextText() {
+	if d.chunk == nil {
+		d.chunk = make([]byte, 4096)
+	}
+	n, err := d.pr.Read(d.chunk)
+	b := d.chunk[:n]
+	if i := bytes.IndexByte(b, '<'); i >= 0 {
+		d.pr.unread(b[i:])
+		d.decodeText(b[:i], true)
+		d.nextTag()
+		return
+	}
+	d.decodeText(b, false)
+	switch {
+	case err == io.EOF:
+		// The page is truncated, so take what we have.
+		d.decodeText(nil, true)
+		d.inText = false
+		d.cutShort()
+	case err != nil:
+		d.err = err
+	}
+}
+
+// nextTag processes a tag inside an element carrying payload.
+func (d *Decoder) nextTag() {
+	z := html.NewTokenizer(d.pr)
+	defer func() {
+		d.pr.unread(z.Buffered())
+	}()
+	switch z.Next() {
+	case html.ErrorToken:
+		if z.Err() != io.EOF {
+			d.err = z.Err()
+			return
+		}
+		d.inText = false
+	case html.StartTagToken:
+		name, hasAttr := z.TagName()
+		tag := string(name)
+		if isInjected(z, tag, hasAttr) {
+			if err := skipElement(z, tag); err == io.EOF {
+				d.inText = false
+			} else if err != nil {
+				d.err = err
+			}
+			return
+		}
+		if tag == d.tag {
+			d.depth++
+		}
+	case html.EndTagToken:
+		if name, _ := z.TagName(); string(name) == d.tag {
+			if d.depth == 0 {
+				d.inText = false
+				return
+			}
+			d.depth--
+		}
+	case html.TextToken:
+		// A stray '<' is text.
+		d.decodeText(z.Text(), true)
+	}
+}
+
+// isInjected reports whether the text of the element with tag,
+// which the tokenizer z is at the start of, is not the text
+// of the page, as in the elements AMP caches inject.
+// The JSON scripts carry data, so they are not skipped.
+func isInjected(z *html.Tokenizer, tag string, hasAttr bool) bool {
+	switch tag {
+	case "style", "noscript", "template":
+		return true
+	case "script":
+		for hasAttr {
+			var key, val []byte
+			key, val, hasAttr = z.TagAttr()
+			if string(key) == "type" && string(val) == "application/json" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// skipElement skips the content of the element with tag
+// which the tokenizer z is at the start of.
+func skipElement(z *html.Tokenizer, tag string) error {
+	depth := 0
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return z.Err()
+		case html.StartTagToken:
+			if name, _ := z.TagName(); string(name) == tag {
+				depth++
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == tag {
+				if depth == 0 {
+					return nil
+				}
+				depth--
+			}
+		}
+	}
+}
+
+// decodeText unescapes the raw text b and decodes it. Unless final,
+// an incomplete character reference or UTF-8 sequence is held back.
+func (d *Decoder) decodeText(b []byte, final bool) {
+	d.text = append(d.text, b...)
+	text := d.text
+	var rest []byte
+	if !final {
+		if i := bytes.LastIndexByte(text, '&'); i >= 0 &&
+			len(text)-i < maxEntityLength && bytes.IndexByte(text[i:], ';') < 0 {
+			text, rest = text[:i], text[i:]
+		}
+		for i := len(text) - 1; i >= 0 && i >= len(text)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(text[i]) {
+				if !utf8.FullRune(text[i:]) {
+					text, rest = text[:i], d.text[i:]
+				}
+				break
+			}
+		}
+	}
+	d.decode(d.carrier.Extract([]byte(html.UnescapeString(string(text)))))
+	d.text = append(d.text[:0], rest...)
+}
+
+// decode decodes complete quanta of the payload text.
+func (d *Decoder) decode(text []byte) {
+	if d.err != nil {
+		return
+	}
+	d.quanta = append(d.quanta, removeSpaces(text)...)
+	if d.encoding == nil {
+		enc, framed, n, err := detectEncoding(d.quanta)
+		if err != nil {
+			d.err = err
+			return
+		}
+		if enc == nil {
+			return
+		}
+		switch {
+		case framed && !d.framed:
+			d.err = fmt.Errorf("%w: payload is framed", ErrFraming)
+			return
+		case !framed && d.framed:
+			d.err = fmt.Errorf("%w: payload is not framed", ErrFraming)
+			return
+		}
+		d.encoding = enc
+		d.quanta = d.quanta[:copy(d.quanta, d.quanta[n:])]
+	}
+	n := len(d.quanta) / d.encoding.quantum * d.encoding.quantum
+	d.decodeQuanta(d.quanta[:n])
+	d.quanta = d.quanta[:copy(d.quanta, d.quanta[n:])]
+}
+
+func (d *Decoder) decodeQuanta(q []byte) {
+	if len(q) == 0 || d.err != nil {
+		return
+	}
+	if d.encoding == nil {
+		d.err = fmt.Errorf("%w: incomplete encoding marker", ErrMalformedPayload)
+		return
+	}
+	b, err := d.encoding.decode(q)
 	if err != nil {
-		return nil, err
+		d.err = fmt.Errorf("%w: %v", ErrMalformedPayload, err)
+		return
+	}
+	d.size += int64(len(b))
+	if d.maxSize != 0 && d.size > d.maxSize {
+		d.err = ErrTooLarge
+		return
+	}
+	d.buf = append(d.buf, b...)
+}
+
+// finishData decodes the trailing incomplete quantum.
+func (d *Decoder) finishData() {
+	d.decodeQuanta(d.quanta)
+	d.quanta = nil
+	d.cutShort()
+}
+
+// cutShort reports the malformed end of framed payload as
+// truncation, since payload cut short may end with an incomplete
+// quantum or character.
+func (d *Decoder) cutShort() {
+	if d.framed && errors.Is(d.err, ErrMalformedPayload) {
+		d.err = ErrTruncated
+	}
+}
+
+// readStatus reads the text of the status element with tag.
+// It returns io.EOF on success.
+func (d *Decoder) readStatus(tag string, selfClosing bool) error {
+	if selfClosing {
+		return ErrMalformedStatus
+	}
+	text := &strings.Builder{}
+	depth := 0
+	for {
+		switch d.z.Next() {
+		case html.ErrorToken:
+			if d.z.Err() != io.EOF {
+				return d.z.Err()
+			}
+			return ErrMalformedStatus
+		case html.TextToken:
+			text.Write(d.z.Text())
+		case html.StartTagToken:
+			name, hasAttr := d.z.TagName()
+			switch {
+			case isInjected(d.z, string(name), hasAttr):
+				if err := skipElement(d.z, string(name)); err != nil {
+					return ErrMalformedStatus
+				}
+			case string(name) == tag:
+				depth++
+			}
+		case html.EndTagToken:
+			if name, _ := d.z.TagName(); string(name) != tag {
+				continue
+			}
+			if depth != 0 {
+				depth--
+				continue
+			}
+			st, err := parseStatus(text.String())
+			if err != nil {
+				return err
+			}
+			d.status = st
+			return io.EOF
+		}
+	}
+}
+
+func (d *Decoder) Read(p []byte) (int, error) {
+	if d.frame != nil {
+		return d.frame.Read(p)
+	}
+	return d.readPayload(p)
+}
+
+// readPayload reads the payload as it is in the page.
+func (d *Decoder) readPayload(p []byte) (int, error) {
+	for len(d.buf) == 0 && d.err == nil {
+		d.next()
+	}
+	if len(d.buf) == 0 {
+		return 0, d.err
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// Status returns the status of the page. It is available
+// once the payload is read to the end, and it is nil
+// if the page has no status, as pages of older servers do.
+func (d *Decoder) Status() *Status {
+	return d.status
+}
+
+// Close closes the Decoder. It does not close the page reader.
+func (d *Decoder) Close() error {
+	return nil
+}
+
+// Decode extracts payload and status from an AMP page body r.
+// Unlike Decoder, it reads the page to the end before returning.
+// The status is nil if the page has none, as pages
+// of older servers do.
+func Decode(r io.Reader) (io.ReadCloser, *Status, error) {
+	d, err := (&DecoderConfig{}).NewDecoder(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := io.ReadAll(d)
+	if err != nil {
+		return nil, nil, err
 	}
-	br := bytes.NewReader(b)
-	return io.NopCloser(br), nil
+	return io.NopCloser(bytes.NewReader(data)), d.Status(), nil
 }
@@ -8,33 +8,47 @@
 package ampcodec
 
 import (
-	"encoding/base64"
 	"errors"
 	"fmt"
+	"html"
 	"io"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"unicode/utf8"
 )
 
 var (
 	ampOldBoilerplate = "<style>body {opacity: 0}</style><noscript><style>body {opacity: 1}</style></noscript>"
 	ampBoilerplate    = "<style amp-boilerplate>body{-webkit-animation:-amp-start 8s steps(1,end) 0s 1 normal both;-moz-animation:-amp-start 8s steps(1,end) 0s 1 normal both;-ms-animation:-amp-start 8s steps(1,end) 0s 1 normal both;animation:-amp-start 8s steps(1,end) 0s 1 normal both}@-webkit-keyframes -amp-start{from{visibility:hidden}to{visibility:visible}}@-moz-keyframes -amp-start{from{visibility:hidden}to{visibility:visible}}@-ms-keyframes -amp-start{from{visibility:hidden}to{visibility:visible}}@-o-keyframes -amp-start{from{visibility:hidden}to{visibility:visible}}@keyframes -amp-start{from{visibility:hidden}to{visibility:visible}}</style><noscript><style amp-boilerplate>body{-webkit-animation:none;-moz-animation:none;-ms-animation:none;animation:none}</style></noscript>"
 	ampHeaderFormat   = `<!doctype html>
-<html amp>
+<html amp%s>
   <head>
     <meta charset="utf-8">
     <script async src="https://cdn.ampproject.org/v0.js"></script>
-    <title>amp</title>
-    <link rel="canonical" href="#" />
+    <title>%s</title>
+    <link rel="canonical" href="%s">
     <meta name="viewport" content="width=device-width,minimum-scale=1,initial-scale=1">
     %s
   </head>
   <body>
-    <p>In varietate concordia</p>
-    <pre id="data">`
-	ampTrailer = []byte(`</pre>
+    %s
+    `
+	ampTrailerFormat = `
+    <%s id="%s">%d %s</%s>
+    %s
   </body>
-</html>`)
+</html>`
+)
+
+const (
+	// defaultCanonicalURL is the canonical URL of pages
+	// which are not given one.
+	defaultCanonicalURL = "/"
+	// StatusOK is the status code of a successful reply.
+	StatusOK = 200
+	// maxStatusMessageLength limits the length of status message.
+	maxStatusMessageLength = 256
 )
 
 var (
@@ -50,30 +64,153 @@ type Encoder struct {
 	trailerWritten   uint32
 	dataEncoder      io.WriteCloser
 	dataEncoderMutex sync.Mutex
+	chunks           *chunkWriter
+	frame            *frameWriter
 
 	// UseOldBoilerplate sets Encoder to write
 	// deprecated AMP boilerplate. As it's much shorter
 	// than the new one, one may benefit from using it
 	// to save some bandwidth.
-	// Note that it may stop working in future.
+	//
+	// Deprecated: AMP caches reject pages with the old boilerplate.
 	UseOldBoilerplate bool
+	// CanonicalURL is the URL of the page, which AMP requires
+	// to be linked as canonical. Defaults to the site root.
+	CanonicalURL string
+	// Carrier embeds the payload into the page.
+	// If nil, PreCarrier is used.
+	Carrier Carrier
+	// Template provides the template of the page.
+	// If nil, DefaultTemplate is used.
+	Template TemplateSource
+	// Marker marks the elements carrying payload and status.
+	// If nil, FixedMarker is used.
+	Marker Marker
+	// Framed makes the payload framed with its length and checksum,
+	// so that the decoder detects truncation and corruption.
+	// Decoders have to be set to expect framed payload,
+	// and the others fail with ErrFraming.
+	Framed bool
+	// Padding pads the framed payload to hide its size.
+	// It implies Framed.
+	Padding Padding
+	// Encoding is the encoding of payload into text. Decoders
+	// tell the encoding by its marker. Defaults to Base64.
+	Encoding Encoding
+	// Compress makes the payload compressed with DEFLATE
+	// where it gets shorter. It implies Framed.
+	Compress bool
+
+	template *Template
+}
+
+func (enc *Encoder) marker() Marker {
+	if enc.Marker != nil {
+		return enc.Marker
+	}
+	return FixedMarker{}
+}
+
+func (enc *Encoder) carrier() Carrier {
+	if enc.Carrier != nil {
+		return enc.Carrier
+	}
+	return PreCarrier{}
+}
+
+func (enc *Encoder) framed() bool {
+	return enc.Framed || enc.Padding != nil || enc.Compress
+}
+
+// chunkWriter splits the payload text into the chunks of carrier.
+type chunkWriter struct {
+	w       io.Writer
+	carrier Carrier
+	marker  Marker
+	buf     []byte
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	size := cw.carrier.MaxChunkSize()
+	cw.buf = append(cw.buf, p...)
+	for len(cw.buf) >= size {
+		// Do not split characters of multiple bytes.
+		n := size
+		for n > 1 && n < len(cw.buf) && !utf8.RuneStart(cw.buf[n]) {
+			n--
+		}
+		if err := cw.carrier.WriteChunk(cw.w, cw.marker, cw.buf[:n]); err != nil {
+			return 0, err
+		}
+		cw.buf = cw.buf[n:]
+	}
+	return len(p), nil
+}
+
+// flush writes the incomplete chunk.
+func (cw *chunkWriter) flush() error {
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	err := cw.carrier.WriteChunk(cw.w, cw.marker, cw.buf)
+	cw.buf = nil
+	return err
 }
 
 // Close signals Encoder that there will be no data so it may write
-// trailer.
-func (enc *Encoder) Close() (err error) {
+// trailer. The page gets StatusOK status.
+func (enc *Encoder) Close() error {
+	return enc.CloseWithStatus(StatusOK, "")
+}
+
+// CloseWithStatus is like Close but sets the status of the page
+// to code and message. As HTTP status codes are not passed through
+// AMP caches, the status is carried in the page itself.
+// Codes have the same meaning as HTTP status codes.
+func (enc *Encoder) CloseWithStatus(code int, message string) (err error) {
+	if atomic.LoadUint32(&enc.closed) == 1 {
+		return ErrEncoderClosed
+	}
+	// Write AMP header even if there was no data
+	// so that the page is still valid.
+	if err := enc.writeHeader(); err != nil {
+		return err
+	}
 	enc.dataEncoderMutex.Lock()
-	if enc.dataEncoder != nil {
+	if enc.framed() && enc.dataEncoder == nil {
+		// Framed payload is never empty.
+		err = enc.newDataEncoder()
+	}
+	if enc.frame != nil && err == nil {
+		err = enc.frame.Close()
+	}
+	if enc.dataEncoder != nil && err == nil {
 		err = enc.dataEncoder.Close()
+		if err == nil {
+			err = enc.chunks.flush()
+		}
 	}
 	enc.dataEncoderMutex.Unlock()
 	if err != nil {
 		return err
 	}
-	// Write AMP trailer if we wrote the header.
-	if atomic.LoadUint32(&enc.headerWritten) == 1 &&
-		atomic.LoadUint32(&enc.trailerWritten) == 0 {
-		_, err = enc.w.Write(ampTrailer)
+	// Write AMP trailer if we haven't.
+	if atomic.LoadUint32(&enc.trailerWritten) == 0 {
+		if len(message) > maxStatusMessageLength {
+			// Do not split characters of multiple bytes.
+			n := maxStatusMessageLength
+			for n > 0 && !utf8.RuneStart(message[n]) {
+				n--
+			}
+			message = message[:n]
+		}
+		if err := enc.carrier().Close(enc.w, enc.marker()); err != nil {
+			return err
+		}
+		tag := enc.template.statusTag()
+		_, err = fmt.Fprintf(enc.w, ampTrailerFormat, tag, enc.marker().ID(RoleStatus),
+			code, html.EscapeString(message), tag, enc.template.Footer)
+		atomic.StoreUint32(&enc.trailerWritten, 1)
 		if err != nil {
 			return err
 		}
@@ -90,31 +227,104 @@ func NewEncoder(w io.Writer) *Encoder {
 	return enc
 }
 
+// writeHeader writes AMP header if we haven't.
+func (enc *Encoder) writeHeader() (err error) {
+	if atomic.LoadUint32(&enc.headerWritten) == 1 {
+		return nil
+	}
+	atomic.StoreUint32(&enc.headerWritten, 1)
+	head := &strings.Builder{}
+	if enc.UseOldBoilerplate {
+		head.WriteString(ampOldBoilerplate)
+	} else {
+		head.WriteString(ampBoilerplate)
+	}
+	if err := enc.carrier().Head(head); err != nil {
+		return err
+	}
+	canonicalURL := enc.CanonicalURL
+	if canonicalURL == "" {
+		canonicalURL = defaultCanonicalURL
+	}
+	enc.template = DefaultTemplate
+	if enc.Template != nil {
+		enc.template = enc.Template.Template()
+	}
+	lang := ""
+	if enc.template.Lang != "" {
+		lang = fmt.Sprintf(` lang="%s"`, html.EscapeString(enc.template.Lang))
+	}
+	_, err = fmt.Fprintf(enc.w, ampHeaderFormat, lang, html.EscapeString(enc.template.Title),
+		html.EscapeString(canonicalURL), head, enc.template.Header)
+	if err != nil {
+		return err
+	}
+	return enc.carrier().Open(enc.w, enc.marker())
+}
+
+// Flush writes the encoded data to the underlying writer and flushes
+// it if it is a flusher, e.g. http.ResponseWriter. All complete
+// quanta of the encoding are flushed, while the last bytes written
+// of an incomplete group may be held until more data is written
+// or Encoder is closed.
+func (enc *Encoder) Flush() error {
+	if atomic.LoadUint32(&enc.closed) == 1 {
+		return ErrEncoderClosed
+	}
+	// Write the header so that the reader gets the page going.
+	if err := enc.writeHeader(); err != nil {
+		return err
+	}
+	// The text encoder passes complete quanta through right away,
+	// so only the incomplete chunk is to be written out.
+	enc.dataEncoderMutex.Lock()
+	if enc.chunks != nil {
+		if err := enc.chunks.flush(); err != nil {
+			enc.dataEncoderMutex.Unlock()
+			return err
+		}
+	}
+	enc.dataEncoderMutex.Unlock()
+	switch f := enc.w.(type) {
+	case interface{ Flush() error }:
+		return f.Flush()
+	case interface{ Flush() }:
+		f.Flush()
+	}
+	return nil
+}
+
 func (enc *Encoder) Write(p []byte) (n int, err error) {
 	if atomic.LoadUint32(&enc.closed) == 1 {
 		return 0, ErrEncoderClosed
 	}
-	// Write AMP header it we haven't
-	if atomic.LoadUint32(&enc.headerWritten) == 0 {
-		if enc.UseOldBoilerplate {
-			_, err = fmt.Fprintf(enc.w, ampHeaderFormat, ampOldBoilerplate)
-		} else {
-			_, err = fmt.Fprintf(enc.w, ampHeaderFormat, ampBoilerplate)
-		}
-		atomic.StoreUint32(&enc.headerWritten, 1)
-		if err != nil {
-			return 0, err
-		}
+	if err := enc.writeHeader(); err != nil {
+		return 0, err
 	}
 	enc.dataEncoderMutex.Lock()
 	if enc.dataEncoder == nil {
-		w, ok := enc.w.(io.WriteCloser)
-		if !ok {
-			w = nopCloser(enc.w)
-		}
-		padWriter := NewPaddingWriter(w, " ", 32)
-		enc.dataEncoder = base64.NewEncoder(base64.RawURLEncoding, padWriter)
+		err = enc.newDataEncoder()
 	}
 	enc.dataEncoderMutex.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if enc.frame != nil {
+		return enc.frame.Write(p)
+	}
 	return enc.dataEncoder.Write(p)
 }
+
+// newDataEncoder sets up the encoding of payload.
+func (enc *Encoder) newDataEncoder() error {
+	enc.chunks = &chunkWriter{w: enc.w, carrier: enc.carrier(), marker: &chunkMarker{Marker: enc.marker()}}
+	te, err := newTextEncoder(enc.chunks, enc.Encoding, enc.framed())
+	if err != nil {
+		return err
+	}
+	enc.dataEncoder = te
+	if enc.framed() {
+		enc.frame = newFrameWriter(enc.dataEncoder, enc.Padding, enc.Compress)
+	}
+	return nil
+}
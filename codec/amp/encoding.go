@@ -0,0 +1,320 @@
+// encoding.go - binary-to-text encodings of payload.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of amper, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package ampcodec
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math"
+	"unicode/utf8"
+)
+
+// Encoding is a binary-to-text encoding of payload. Payload text
+// of encodings other than Base64, as well as framed payload text,
+// starts with the marker of the encoding, so that the decoder
+// tells them apart.
+type Encoding byte
+
+const (
+	// Base64 is URL-safe Base64 without padding. It is the default
+	// encoding, which older versions use.
+	Base64 Encoding = iota
+	// Base85 encodes 4 bytes into 5 characters out of printable ASCII
+	// but the ones which need escaping in HTML text, attribute values
+	// and JSON strings, as well as '[', ']' and ','.
+	Base85
+	// Base32k encodes 15 bits into a CJK or private use character.
+	// As the characters take 3 bytes of UTF-8, it is less dense
+	// than Base64 in bytes, but it is the densest in characters.
+	Base32k
+)
+
+// encodingMarker starts the marker of the payload text. It is
+// followed by the digit of the encoding for unframed payload,
+// and by the letter of the encoding, framedMarker for Base64,
+// for framed one. Unframed Base64 has no marker.
+const (
+	encodingMarker = '~'
+	framedMarker   = 'A'
+)
+
+// textEncoding encodes payload into text.
+type textEncoding struct {
+	// group is the number of bytes encoded together.
+	group int
+	// quantum is the length of the text of a group.
+	quantum int
+	// encode appends the text of src to dst. Only the last
+	// group of src may be incomplete.
+	encode func(dst, src []byte) []byte
+	// decode decodes the text of src. Only the last
+	// quantum of src may be incomplete.
+	decode func(src []byte) ([]byte, error)
+}
+
+var textEncodings = map[Encoding]*textEncoding{
+	Base64: {
+		group:   3,
+		quantum: 4,
+		encode: func(dst, src []byte) []byte {
+			text := make([]byte, base64.RawURLEncoding.EncodedLen(len(src)))
+			base64.RawURLEncoding.Encode(text, src)
+			return append(dst, text...)
+		},
+		decode: func(src []byte) ([]byte, error) {
+			dst := make([]byte, base64.RawURLEncoding.DecodedLen(len(src)))
+			n, err := base64.RawURLEncoding.Decode(dst, src)
+			return dst[:n], err
+		},
+	},
+	Base85: {
+		group:   4,
+		quantum: 5,
+		encode:  appendBase85,
+		decode:  decodeBase85,
+	},
+	Base32k: {
+		group:   15,
+		quantum: 8 * base32kRuneLength,
+		encode:  appendBase32k,
+		decode:  decodeBase32k,
+	},
+}
+
+// textEncoder writes the text of payload written to it.
+type textEncoder struct {
+	w   io.Writer
+	enc *textEncoding
+	buf []byte
+}
+
+// newTextEncoder returns the encoder writing text of encoding e to w,
+// marking it as framed if framed is set.
+func newTextEncoder(w io.Writer, e Encoding, framed bool) (*textEncoder, error) {
+	enc, ok := textEncodings[e]
+	if !ok {
+		return nil, fmt.Errorf("unknown encoding %d", e)
+	}
+	switch {
+	case framed:
+		_, err := w.Write([]byte{encodingMarker, framedMarker + byte(e)})
+		if err != nil {
+			return nil, err
+		}
+	case e != Base64:
+		if _, err := w.Write([]byte{encodingMarker, '0' + byte(e)}); err != nil {
+			return nil, err
+		}
+	}
+	return &textEncoder{w: w, enc: enc}, nil
+}
+
+func (te *textEncoder) Write(p []byte) (int, error) {
+	te.buf = append(te.buf, p...)
+	n := len(te.buf) / te.enc.group * te.enc.group
+	if n == 0 {
+		return len(p), nil
+	}
+	if _, err := te.w.Write(te.enc.encode(nil, te.buf[:n])); err != nil {
+		return 0, err
+	}
+	te.buf = te.buf[:copy(te.buf, te.buf[n:])]
+	return len(p), nil
+}
+
+// Close writes the text of the incomplete group.
+func (te *textEncoder) Close() error {
+	if len(te.buf) == 0 {
+		return nil
+	}
+	_, err := te.w.Write(te.enc.encode(nil, te.buf))
+	te.buf = nil
+	return err
+}
+
+// detectEncoding returns the encoding of payload text, whether
+// the payload is framed, and the length of its marker.
+// It returns nil if text is too short to tell.
+func detectEncoding(text []byte) (*textEncoding, bool, int, error) {
+	if len(text) == 0 {
+		return nil, false, 0, nil
+	}
+	if text[0] != encodingMarker {
+		return textEncodings[Base64], false, 0, nil
+	}
+	if len(text) < 2 {
+		return nil, false, 0, nil
+	}
+	framed := text[1] >= framedMarker
+	e := Encoding(text[1] - '0')
+	if framed {
+		e = Encoding(text[1] - framedMarker)
+	}
+	enc, ok := textEncodings[e]
+	if !ok || text[1] == '0' {
+		return nil, false, 0, fmt.Errorf("%w: unknown encoding %q", ErrMalformedPayload, text[1])
+	}
+	return enc, framed, 2, nil
+}
+
+// base85Alphabet is printable ASCII without "&'<>[]\, characters.
+var base85Alphabet, base85Values = func() (string, [256]byte) {
+	alphabet := []byte{}
+	var values [256]byte
+	for i := range values {
+		values[i] = 0xff
+	}
+	for c := byte('!'); c <= '~'; c++ {
+		switch c {
+		case '"', '&', '\'', '<', '>', '[', ']', '\\', ',':
+			continue
+		}
+		values[c] = byte(len(alphabet))
+		alphabet = append(alphabet, c)
+	}
+	return string(alphabet), values
+}()
+
+func appendBase85(dst, src []byte) []byte {
+	for len(src) > 0 {
+		n := min(len(src), 4)
+		var v uint32
+		for i := 0; i < 4; i++ {
+			v <<= 8
+			if i < n {
+				v |= uint32(src[i])
+			}
+		}
+		var text [5]byte
+		for i := 4; i >= 0; i-- {
+			text[i] = base85Alphabet[v%85]
+			v /= 85
+		}
+		dst = append(dst, text[:n+1]...)
+		src = src[n:]
+	}
+	return dst
+}
+
+func decodeBase85(src []byte) ([]byte, error) {
+	dst := make([]byte, 0, len(src)/5*4+3)
+	for len(src) > 0 {
+		n := min(len(src), 5)
+		if n == 1 {
+			return nil, fmt.Errorf("illegal base85 data at the end")
+		}
+		var v uint64
+		for i := 0; i < 5; i++ {
+			digit := byte(84)
+			if i < n {
+				digit = base85Values[src[i]]
+				if digit == 0xff {
+					return nil, fmt.Errorf("illegal base85 character %q", src[i])
+				}
+			}
+			v = v*85 + uint64(digit)
+		}
+		if v > math.MaxUint32 {
+			return nil, fmt.Errorf("illegal base85 group %q", src[:n])
+		}
+		b := [4]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+		dst = append(dst, b[:n-1]...)
+		src = src[n:]
+	}
+	return dst, nil
+}
+
+// Base32k uses the CJK Unified Ideographs Extension A and
+// the CJK Unified Ideographs blocks followed by the Private Use Area
+// for 15 bits, and Yi syllables for the last 7 bits or less.
+// None of them have decompositions, so that the text is stable
+// under all forms of Unicode normalization.
+const (
+	base32kRuneLength = 3
+
+	base32kExtA     = 0x3400
+	base32kExtASize = 0x4dc0 - 0x3400
+	base32kCJK      = 0x4e00
+	base32kCJKSize  = 0xa000 - 0x4e00
+	base32kPUA      = 0xe000
+	base32kTail     = 0xa000
+)
+
+func base32kRune(v uint32) rune {
+	switch {
+	case v < base32kExtASize:
+		return rune(base32kExtA + v)
+	case v < base32kExtASize+base32kCJKSize:
+		return rune(base32kCJK + v - base32kExtASize)
+	default:
+		return rune(base32kPUA + v - base32kExtASize - base32kCJKSize)
+	}
+}
+
+// base32kValue returns the value of r and the number of its bits.
+func base32kValue(r rune) (uint32, uint, bool) {
+	switch {
+	case r >= base32kExtA && r < base32kExtA+base32kExtASize:
+		return uint32(r - base32kExtA), 15, true
+	case r >= base32kCJK && r < base32kCJK+base32kCJKSize:
+		return uint32(r-base32kCJK) + base32kExtASize, 15, true
+	case r >= base32kPUA && r < base32kPUA+1<<15-base32kExtASize-base32kCJKSize:
+		return uint32(r-base32kPUA) + base32kExtASize + base32kCJKSize, 15, true
+	case r >= base32kTail && r < base32kTail+1<<7:
+		return uint32(r - base32kTail), 7, true
+	}
+	return 0, 0, false
+}
+
+func appendBase32k(dst, src []byte) []byte {
+	var acc uint32
+	var bits uint
+	for _, b := range src {
+		acc = acc<<8 | uint32(b)
+		bits += 8
+		if bits >= 15 {
+			bits -= 15
+			dst = utf8.AppendRune(dst, base32kRune(acc>>bits))
+			acc &= 1<<bits - 1
+		}
+	}
+	// The rest of bits is padded with ones.
+	switch {
+	case bits > 7:
+		dst = utf8.AppendRune(dst, base32kRune(acc<<(15-bits)|(1<<(15-bits)-1)))
+	case bits > 0:
+		dst = utf8.AppendRune(dst, rune(base32kTail+(acc<<(7-bits)|(1<<(7-bits)-1))))
+	}
+	return dst
+}
+
+func decodeBase32k(src []byte) ([]byte, error) {
+	dst := make([]byte, 0, len(src)/base32kRuneLength*15/8+1)
+	var acc uint32
+	var bits uint
+	for len(src) > 0 {
+		r, size := utf8.DecodeRune(src)
+		v, n, ok := base32kValue(r)
+		if !ok {
+			return nil, fmt.Errorf("illegal base32k character %q", r)
+		}
+		src = src[size:]
+		if n == 7 && len(src) != 0 {
+			return nil, fmt.Errorf("base32k data after the last character")
+		}
+		acc = acc<<n | v
+		bits += n
+		for bits >= 8 {
+			bits -= 8
+			dst = append(dst, byte(acc>>bits))
+		}
+		acc &= 1<<bits - 1
+	}
+	return dst, nil
+}
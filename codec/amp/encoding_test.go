@@ -0,0 +1,172 @@
+package ampcodec
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/matryer/is"
+	"golang.org/x/text/unicode/norm"
+)
+
+var encodings = map[string]Encoding{
+	"base64":  Base64,
+	"base85":  Base85,
+	"base32k": Base32k,
+}
+
+func TestEncodings(t *testing.T) {
+	carriers := map[string]Carrier{
+		"pre":       PreCarrier{},
+		"multi":     MultiElementCarrier{ChunkSize: 100},
+		"json":      JSONCarrier{ChunkSize: 100},
+		"attribute": AttributeCarrier{ChunkSize: 100},
+	}
+	for name, encoding := range encodings {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			for _, carrier := range carriers {
+				for n := 0; n < 40; n++ {
+					input := make([]byte, n)
+					rand.Read(input)
+					if n == 39 {
+						input = make([]byte, 10000)
+						rand.Read(input)
+					}
+					buf := &bytes.Buffer{}
+					enc := NewEncoder(buf)
+					enc.Encoding = encoding
+					enc.Carrier = carrier
+					_, err := enc.Write(input)
+					is.NoErr(err)
+					is.NoErr(enc.Close())
+					is.Equal(validateAMP(buf.Bytes()), nil)
+
+					cfg := &DecoderConfig{Carrier: carrier}
+					dec, err := cfg.NewDecoder(iotest.OneByteReader(bytes.NewReader(buf.Bytes())))
+					is.NoErr(err)
+					output, err := io.ReadAll(dec)
+					is.NoErr(err)
+					is.Equal(output, input)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodingsFramed(t *testing.T) {
+	for name, encoding := range encodings {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			input := bytes.Repeat([]byte("amper"), 100)
+			buf := &bytes.Buffer{}
+			enc := NewEncoder(buf)
+			enc.Encoding = encoding
+			enc.Framed = true
+			_, err := enc.Write(input[:7])
+			is.NoErr(err)
+			is.NoErr(enc.Flush())
+			_, err = enc.Write(input[7:])
+			is.NoErr(err)
+			is.NoErr(enc.Close())
+			page := buf.String()
+			cfg := &DecoderConfig{Framed: true}
+			dec, err := cfg.NewDecoder(strings.NewReader(page))
+			is.NoErr(err)
+			output, err := io.ReadAll(dec)
+			is.NoErr(err)
+			is.Equal(output, input)
+
+			// Cut short, as by a CDN.
+			start := strings.Index(page, `<pre id="data">`) + len(`<pre id="data">`)
+			for _, cut := range []int{start + 100, start + 101, start + 102} {
+				dec, err := cfg.NewDecoder(strings.NewReader(page[:cut]))
+				is.NoErr(err)
+				_, err = io.ReadAll(dec)
+				is.Equal(err, ErrTruncated)
+			}
+		})
+	}
+}
+
+func TestEncodingMarker(t *testing.T) {
+	is := is.New(t)
+	for _, page := range []string{
+		`<pre id="data">~0AAAA</pre>`,
+		`<pre id="data">~9AAAA</pre>`,
+		`<pre id="data">~</pre>`,
+		`<pre id="data">~1"AAAA</pre>`,
+		`<pre id="data">~2AAAA</pre>`,
+	} {
+		_, _, err := Decode(strings.NewReader(page))
+		is.True(err != nil) // page must be rejected
+	}
+}
+
+func TestBase32kNormalization(t *testing.T) {
+	is := is.New(t)
+	// The input packs every 15-bit value in turn,
+	// followed by a byte for the tail.
+	var input []byte
+	var acc uint32
+	var bits uint
+	for v := uint32(0); v < 1<<15; v++ {
+		acc = acc<<15 | v
+		for bits += 15; bits >= 8; bits -= 8 {
+			input = append(input, byte(acc>>(bits-8)))
+		}
+		acc &= 1<<bits - 1
+	}
+	input = append(input, 0xa5)
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	enc.Encoding = Base32k
+	_, err := enc.Write(input)
+	is.NoErr(err)
+	is.NoErr(enc.Close())
+	for _, form := range []norm.Form{norm.NFC, norm.NFD, norm.NFKC, norm.NFKD} {
+		page := form.Bytes(buf.Bytes())
+		is.Equal(page, buf.Bytes()) // page must not change
+		dec, err := NewDecoder(bytes.NewReader(page))
+		is.NoErr(err)
+		output, err := io.ReadAll(dec)
+		is.NoErr(err)
+		is.Equal(output, input)
+	}
+}
+
+func BenchmarkEncodings(b *testing.B) {
+	input := make([]byte, 1<<16)
+	rand.Read(input)
+	for _, name := range []string{"base64", "base85", "base32k"} {
+		encoding := encodings[name]
+		buf := &bytes.Buffer{}
+		b.Run(fmt.Sprintf("encode/%s", name), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				enc := NewEncoder(buf)
+				enc.Encoding = encoding
+				enc.Write(input)
+				enc.Close()
+			}
+			// Page bytes per payload byte.
+			b.ReportMetric(float64(buf.Len())/float64(len(input)), "page-B/B")
+		})
+		page := buf.Bytes()
+		b.Run(fmt.Sprintf("decode/%s", name), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				dec, err := NewDecoder(bytes.NewReader(page))
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(io.Discard, dec)
+			}
+		})
+	}
+}
@@ -0,0 +1,311 @@
+// frame.go - framing of the payload of AMP pages.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of amper, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package ampcodec
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// The frame of the payload is the version byte followed by records.
+// A record is its kind byte, the uvarint length of its body, and
+// the body. Data records carry the payload, and the end record
+// carries the uvarint length of the payload and its CRC-32C,
+// so that the decoder detects payload cut short or corrupted.
+// Padding records carry random bytes, which the decoder skips.
+// Deflate records carry payload compressed with DEFLATE.
+const (
+	frameVersion = 1
+
+	recordData    = 1
+	recordEnd     = 2
+	recordPadding = 3
+	recordDeflate = 4
+
+	// maxRecordSize limits the size of a record body,
+	// as well as the size of a decompressed one.
+	maxRecordSize = 1 << 20
+)
+
+var (
+	// ErrTruncated designates that the framed payload ends
+	// before its end record.
+	ErrTruncated = errors.New("payload is truncated")
+	// ErrChecksum designates that the framed payload does not
+	// match the length and checksum of its end record.
+	ErrChecksum = errors.New("payload checksum mismatch")
+	// ErrFraming designates that the payload is framed while
+	// the decoder does not expect it, or the other way around.
+	ErrFraming = errors.New("payload framing mismatch")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// frameWriter frames the payload written to it.
+type frameWriter struct {
+	w             io.Writer
+	padding       Padding
+	compressor    *flate.Writer
+	compressed    bytes.Buffer
+	headerWritten bool
+	size          uint64
+	crc           hash.Hash32
+	// written is the number of bytes of the frame written.
+	written int64
+}
+
+func newFrameWriter(w io.Writer, padding Padding, compress bool) *frameWriter {
+	fw := &frameWriter{
+		w:       w,
+		padding: padding,
+		crc:     crc32.New(crcTable),
+	}
+	if compress {
+		fw.compressor, _ = flate.NewWriter(&fw.compressed, flate.DefaultCompression)
+	}
+	return fw
+}
+
+// writeData writes body as a data record, compressed
+// if the frame is compressed and it gets shorter.
+func (fw *frameWriter) writeData(body []byte) error {
+	if fw.compressor == nil {
+		return fw.writeRecord(recordData, body)
+	}
+	fw.compressed.Reset()
+	fw.compressor.Reset(&fw.compressed)
+	if _, err := fw.compressor.Write(body); err != nil {
+		return err
+	}
+	if err := fw.compressor.Close(); err != nil {
+		return err
+	}
+	if fw.compressed.Len() >= len(body) {
+		return fw.writeRecord(recordData, body)
+	}
+	return fw.writeRecord(recordDeflate, fw.compressed.Bytes())
+}
+
+func (fw *frameWriter) writeRecord(kind byte, body []byte) error {
+	var b []byte
+	if !fw.headerWritten {
+		b = append(b, frameVersion)
+		fw.headerWritten = true
+	}
+	b = append(b, kind)
+	b = binary.AppendUvarint(b, uint64(len(body)))
+	b = append(b, body...)
+	n, err := fw.w.Write(b)
+	fw.written += int64(n)
+	return err
+}
+
+// recordSize returns the size of the record with body of size n.
+func recordSize(n int64) int64 {
+	return 1 + int64(len(binary.AppendUvarint(nil, uint64(n)))) + n
+}
+
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	for n := 0; n < len(p); {
+		body := p[n:min(len(p), n+maxRecordSize)]
+		if err := fw.writeData(body); err != nil {
+			return n, err
+		}
+		fw.size += uint64(len(body))
+		fw.crc.Write(body)
+		n += len(body)
+	}
+	return len(p), nil
+}
+
+// pad writes padding records of n bytes in total. As a record takes
+// at least two bytes, padding of a single byte takes two.
+func (fw *frameWriter) pad(n int64) error {
+	for n > 0 {
+		body := min(n, maxRecordSize)
+		for body > 0 && recordSize(body) > n {
+			body--
+		}
+		if rest := n - recordSize(body); rest == 1 && body > 0 {
+			// Leave room for one more record.
+			body--
+		}
+		b := make([]byte, body)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		if err := fw.writeRecord(recordPadding, b); err != nil {
+			return err
+		}
+		n -= recordSize(body)
+	}
+	return nil
+}
+
+// Close pads the frame and writes the end record.
+func (fw *frameWriter) Close() error {
+	body := binary.AppendUvarint(nil, fw.size)
+	body = binary.BigEndian.AppendUint32(body, fw.crc.Sum32())
+	if fw.padding != nil {
+		n := fw.written + recordSize(int64(len(body)))
+		if !fw.headerWritten {
+			n++
+		}
+		if err := fw.pad(fw.padding.Size(n) - n); err != nil {
+			return err
+		}
+	}
+	return fw.writeRecord(recordEnd, body)
+}
+
+// frameReader reads the payload out of its frame.
+type frameReader struct {
+	r       *bufio.Reader
+	started bool
+	// left is the number of bytes left in the current data record.
+	left uint64
+	// inflated holds the rest of the current deflate record.
+	inflated []byte
+	maxSize  int64
+	size     uint64
+	crc      hash.Hash32
+	err      error
+}
+
+// newFrameReader returns the reader of the frame of at most
+// maxSize bytes of payload. Zero maxSize means no limit.
+func newFrameReader(r io.Reader, maxSize int64) *frameReader {
+	return &frameReader{
+		r:       bufio.NewReader(r),
+		maxSize: maxSize,
+		crc:     crc32.New(crcTable),
+	}
+}
+
+// truncated turns the end of the frame into ErrTruncated.
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	return err
+}
+
+// nextRecord reads the header of the next record. It reads
+// and verifies the end record, returning io.EOF on success.
+func (fr *frameReader) nextRecord() error {
+	if !fr.started {
+		version, err := fr.r.ReadByte()
+		if err != nil {
+			return truncated(err)
+		}
+		if version != frameVersion {
+			return fmt.Errorf("%w: unsupported frame version %d", ErrMalformedPayload, version)
+		}
+		fr.started = true
+	}
+	kind, err := fr.r.ReadByte()
+	if err != nil {
+		return truncated(err)
+	}
+	length, err := binary.ReadUvarint(fr.r)
+	if err != nil {
+		return truncated(err)
+	}
+	if length > maxRecordSize {
+		return fmt.Errorf("%w: record is too large", ErrMalformedPayload)
+	}
+	switch kind {
+	case recordData:
+		fr.left = length
+		return nil
+	case recordDeflate:
+		body := make([]byte, length)
+		if _, err := io.ReadFull(fr.r, body); err != nil {
+			return truncated(err)
+		}
+		// Decompress no more than a record may carry,
+		// so that compression bombs are not inflated.
+		r := flate.NewReader(bytes.NewReader(body))
+		fr.inflated, err = io.ReadAll(io.LimitReader(r, maxRecordSize+1))
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrMalformedPayload, err)
+		}
+		if len(fr.inflated) > maxRecordSize {
+			return fmt.Errorf("%w: record is too large", ErrMalformedPayload)
+		}
+		return nil
+	case recordPadding:
+		if _, err := fr.r.Discard(int(length)); err != nil {
+			return truncated(err)
+		}
+		return nil
+	case recordEnd:
+		body := make([]byte, length)
+		if _, err := io.ReadFull(fr.r, body); err != nil {
+			return truncated(err)
+		}
+		size, n := binary.Uvarint(body)
+		if n <= 0 || len(body[n:]) != 4 {
+			return fmt.Errorf("%w: malformed end record", ErrMalformedPayload)
+		}
+		if size != fr.size || binary.BigEndian.Uint32(body[n:]) != fr.crc.Sum32() {
+			return ErrChecksum
+		}
+		if _, err := fr.r.ReadByte(); err != io.EOF {
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: data after end record", ErrMalformedPayload)
+		}
+		return io.EOF
+	default:
+		return fmt.Errorf("%w: unknown record kind %d", ErrMalformedPayload, kind)
+	}
+}
+
+func (fr *frameReader) Read(p []byte) (int, error) {
+	for fr.left == 0 && len(fr.inflated) == 0 && fr.err == nil {
+		fr.err = fr.nextRecord()
+	}
+	if len(fr.inflated) != 0 {
+		n := copy(p, fr.inflated)
+		fr.inflated = fr.inflated[n:]
+		return fr.account(p[:n])
+	}
+	if fr.err != nil {
+		return 0, fr.err
+	}
+	if uint64(len(p)) > fr.left {
+		p = p[:fr.left]
+	}
+	n, err := fr.r.Read(p)
+	fr.left -= uint64(n)
+	if err != nil {
+		fr.err = truncated(err)
+	}
+	return fr.account(p[:n])
+}
+
+// account adds p read to the size and the checksum of payload.
+func (fr *frameReader) account(p []byte) (int, error) {
+	fr.size += uint64(len(p))
+	fr.crc.Write(p)
+	if fr.maxSize != 0 && fr.size > uint64(fr.maxSize) {
+		fr.err = ErrTooLarge
+		return 0, fr.err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,142 @@
+// marker.go - marking of the elements of AMP pages.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of amper, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package ampcodec
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// Roles of the marked elements.
+const (
+	// RoleData is the role of the elements carrying payload.
+	RoleData = "data"
+	// RoleStatus is the role of the element carrying status.
+	RoleStatus = "status"
+)
+
+// Marker marks the elements of a page with IDs, so that the decoder
+// finds the elements carrying payload and status among the others.
+// Encoder and Decoder have to use the same Marker.
+type Marker interface {
+	// ID returns the ID of a new element with role.
+	ID(role string) string
+	// Role returns the role of the element with id,
+	// or an empty string if the element is not marked.
+	Role(id string) string
+}
+
+// FixedMarker marks elements with IDs equal to their roles.
+// It is the default marker, which older versions use.
+type FixedMarker struct{}
+
+func (FixedMarker) ID(role string) string {
+	return role
+}
+
+func (FixedMarker) Role(id string) string {
+	switch id {
+	case RoleData, RoleStatus:
+		return id
+	}
+	return ""
+}
+
+// chunkMarker marks the elements carrying chunks of payload
+// with unique IDs. The IDs which Marker repeats, as FixedMarker
+// does, get the index of the chunk appended.
+type chunkMarker struct {
+	Marker
+	first string
+	index int
+}
+
+func (m *chunkMarker) ID(role string) string {
+	id := m.Marker.ID(role)
+	m.index++
+	if m.index == 1 {
+		m.first = id
+		return id
+	}
+	if id == m.first {
+		return id + "-" + strconv.Itoa(m.index-1)
+	}
+	return id
+}
+
+// chunkRole returns the role of the element with id, which
+// may have the index of the chunk appended by chunkMarker.
+func chunkRole(m Marker, id string) string {
+	if role := m.Role(id); role != "" {
+		return role
+	}
+	i := strings.LastIndexByte(id, '-')
+	if i < 0 {
+		return ""
+	}
+	if n, err := strconv.Atoi(id[i+1:]); err != nil || n < 1 {
+		return ""
+	}
+	if role := m.Role(id[:i]); role == RoleData {
+		return role
+	}
+	return ""
+}
+
+const (
+	secretIDNonceSize = 4
+	secretIDTagSize   = 4
+)
+
+// secretIDPrefixes are the prefixes of the IDs of SecretMarker.
+var secretIDPrefixes = []string{
+	"section", "post", "item", "block", "entry", "content", "note", "card",
+}
+
+// SecretMarker marks elements with IDs derived from Secret. The IDs
+// look random and differ on every page, yet the decoder knowing
+// Secret tells the marked elements apart.
+type SecretMarker struct {
+	// Secret is the secret shared by servers and clients.
+	Secret []byte
+}
+
+func (m SecretMarker) tag(role string, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, m.Secret)
+	mac.Write([]byte(role))
+	mac.Write(nonce)
+	return mac.Sum(nil)[:secretIDTagSize]
+}
+
+func (m SecretMarker) ID(role string) string {
+	nonce := make([]byte, secretIDNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	prefix := secretIDPrefixes[int(nonce[0])%len(secretIDPrefixes)]
+	return prefix + "-" + hex.EncodeToString(append(nonce, m.tag(role, nonce)...))
+}
+
+func (m SecretMarker) Role(id string) string {
+	i := strings.LastIndexByte(id, '-')
+	b, err := hex.DecodeString(id[i+1:])
+	if err != nil || len(b) != secretIDNonceSize+secretIDTagSize {
+		return ""
+	}
+	nonce, tag := b[:secretIDNonceSize], b[secretIDNonceSize:]
+	for _, role := range []string{RoleData, RoleStatus} {
+		if hmac.Equal(tag, m.tag(role, nonce)) {
+			return role
+		}
+	}
+	return ""
+}
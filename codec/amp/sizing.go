@@ -0,0 +1,70 @@
+// sizing.go - padding of payload to hide its size.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of amper, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package ampcodec
+
+import (
+	"math/rand"
+)
+
+// Padding is a policy of padding framed payload, so that the size
+// of pages does not tell the size of payload. The padding is carried
+// inside the frame and is stripped by the decoder.
+type Padding interface {
+	// Size returns the size to pad the frame of size n to.
+	// Sizes less than n leave the frame unpadded.
+	Size(n int64) int64
+}
+
+// DefaultMinBucket is the smallest bucket of BucketPadding
+// without explicit buckets.
+const DefaultMinBucket = 1024
+
+// BucketPadding pads frames to the smallest of Buckets which fits them.
+// Frames larger than the largest bucket are padded to its multiple.
+type BucketPadding struct {
+	// Buckets are the sizes to pad to in increasing order.
+	// If empty, frames are padded to powers of two,
+	// starting from DefaultMinBucket.
+	Buckets []int64
+}
+
+func (p BucketPadding) Size(n int64) int64 {
+	if len(p.Buckets) == 0 {
+		size := int64(DefaultMinBucket)
+		for size < n {
+			size *= 2
+		}
+		return size
+	}
+	for _, size := range p.Buckets {
+		if size >= n {
+			return size
+		}
+	}
+	largest := p.Buckets[len(p.Buckets)-1]
+	if largest <= 0 {
+		return n
+	}
+	return (n + largest - 1) / largest * largest
+}
+
+// RandomPadding pads frames with a random number of bytes
+// drawn uniformly from [Min, Max].
+type RandomPadding struct {
+	// Min is the least number of padding bytes.
+	Min int64
+	// Max is the greatest number of padding bytes.
+	Max int64
+}
+
+func (p RandomPadding) Size(n int64) int64 {
+	if p.Max <= p.Min {
+		return n + p.Min
+	}
+	return n + p.Min + rand.Int63n(p.Max-p.Min+1)
+}
@@ -0,0 +1,128 @@
+// template.go - templates of AMP pages.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of amper, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package ampcodec
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// Template is the page around the payload.
+type Template struct {
+	// Lang is the language of the page.
+	Lang string
+	// Title is the title of the page.
+	Title string
+	// Header is the markup of the body preceding the payload.
+	Header string
+	// Footer is the markup of the body following the status.
+	// It closes the elements Header leaves open.
+	Footer string
+	// StatusTag is the name of the element carrying status.
+	// Defaults to "pre".
+	StatusTag string
+}
+
+// Template returns t itself, so that a Template
+// is a TemplateSource of a single template.
+func (t *Template) Template() *Template {
+	return t
+}
+
+func (t *Template) statusTag() string {
+	if t.StatusTag != "" {
+		return t.StatusTag
+	}
+	return "pre"
+}
+
+// DefaultTemplate is the template used by default,
+// which older versions use.
+var DefaultTemplate = &Template{
+	Title:  "amp",
+	Header: "<p>In varietate concordia</p>",
+}
+
+// TemplateSource provides the templates of pages.
+type TemplateSource interface {
+	// Template returns the template of a new page.
+	Template() *Template
+}
+
+// TemplatePool is a TemplateSource which picks
+// one of its templates at random.
+type TemplatePool []*Template
+
+func (p TemplatePool) Template() *Template {
+	return p[rand.Intn(len(p))]
+}
+
+// RandomTemplates is a TemplateSource which generates templates
+// with random language, title, cover text and structure.
+type RandomTemplates struct{}
+
+var (
+	templateLangs      = []string{"en", "en-US", "en-GB", "de", "fr", "es", "it", "nl"}
+	templateAdjectives = []string{
+		"Quiet", "Simple", "Daily", "Practical", "Modern", "Small", "Green",
+		"Open", "Local", "Weekly", "Curious", "Better", "Slow", "Bright",
+	}
+	templateNouns = []string{
+		"Notes", "Gardening", "Recipes", "Journal", "Kitchen", "Travels",
+		"Workshop", "Almanac", "Letters", "Field Guide", "Digest", "Review",
+	}
+	templateSentences = []string{
+		"The weather turned warmer this week, and the market was busier than usual.",
+		"We tried a new approach to an old problem and were surprised by the results.",
+		"Readers keep asking about the details, so here they are in full.",
+		"Most of the work happens early in the morning, before anyone else is awake.",
+		"It took a few attempts, but the second version turned out much better.",
+		"A short update on what changed since the last time we wrote.",
+		"Nothing here is new, but it is worth repeating once in a while.",
+		"The list below is not complete, and it will keep growing.",
+		"Thanks to everyone who sent in suggestions over the past month.",
+		"Some of these ideas came from conversations with neighbours.",
+		"Keep it simple, measure twice, and do not rush the last step.",
+		"The archive has more on this topic for those who are interested.",
+	}
+	templateContainers = []string{"article", "section", "main", "div"}
+	templateClasses    = []string{"content", "post", "entry", "page", "body", "text", "story"}
+	templateStatusTags = []string{"pre", "p", "div", "span"}
+)
+
+func pick(s []string) string {
+	return s[rand.Intn(len(s))]
+}
+
+func (RandomTemplates) Template() *Template {
+	title := pick(templateAdjectives) + " " + pick(templateNouns)
+	header := &strings.Builder{}
+	footer := []string{}
+	for i := rand.Intn(3); i >= 0; i-- {
+		container := pick(templateContainers)
+		fmt.Fprintf(header, `<%s class="%s">`, container, pick(templateClasses))
+		footer = append([]string{"</" + container + ">"}, footer...)
+		if i == 0 || rand.Intn(2) == 0 {
+			fmt.Fprintf(header, "<h%d>%s</h%d>", i+1, title, i+1)
+		}
+		for j := rand.Intn(3); j >= 0; j-- {
+			fmt.Fprintf(header, "<p>%s</p>", pick(templateSentences))
+		}
+	}
+	if rand.Intn(2) == 0 {
+		footer = append(footer, "<footer><p>"+pick(templateSentences)+"</p></footer>")
+	}
+	return &Template{
+		Lang:      pick(templateLangs),
+		Title:     title,
+		Header:    header.String(),
+		Footer:    strings.Join(footer, ""),
+		StatusTag: pick(templateStatusTags),
+	}
+}
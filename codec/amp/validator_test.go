@@ -0,0 +1,353 @@
+package ampcodec
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"golang.org/x/net/html"
+)
+
+// This file vendors the subset of the AMP validator rules
+// (https://github.com/ampproject/amphtml/tree/main/validator)
+// which matter for the pages of the encoder, so that changes
+// of the page template are checked offline.
+
+const (
+	validatorRuntimeURL          = "https://cdn.ampproject.org/v0.js"
+	validatorBoilerplate         = "body{-webkit-animation:-amp-start 8s steps(1,end) 0s 1 normal both;-moz-animation:-amp-start 8s steps(1,end) 0s 1 normal both;-ms-animation:-amp-start 8s steps(1,end) 0s 1 normal both;animation:-amp-start 8s steps(1,end) 0s 1 normal both}@-webkit-keyframes -amp-start{from{visibility:hidden}to{visibility:visible}}@-moz-keyframes -amp-start{from{visibility:hidden}to{visibility:visible}}@-ms-keyframes -amp-start{from{visibility:hidden}to{visibility:visible}}@-o-keyframes -amp-start{from{visibility:hidden}to{visibility:visible}}@keyframes -amp-start{from{visibility:hidden}to{visibility:visible}}"
+	validatorNoscriptBoilerplate = "body{-webkit-animation:none;-moz-animation:none;-ms-animation:none;animation:none}"
+)
+
+var (
+	validatorExtensionURL = regexp.MustCompile(`^https://cdn\.ampproject\.org/v0/(amp-[a-z0-9-]+)-(0\.1|[0-9]\.[0-9]|latest)\.js$`)
+	// validatorBuiltins are the AMP elements of the runtime.
+	validatorBuiltins = map[string]bool{
+		"amp-img":    true,
+		"amp-layout": true,
+		"amp-pixel":  true,
+	}
+	// validatorExtensions maps the AMP elements which
+	// are not named after their extensions.
+	validatorExtensions = map[string]string{
+		"amp-state":      "amp-bind",
+		"amp-bind-macro": "amp-bind",
+	}
+	validatorDisallowed = map[string]bool{
+		"applet":   true,
+		"audio":    true,
+		"embed":    true,
+		"frame":    true,
+		"frameset": true,
+		"iframe":   true,
+		"img":      true,
+		"object":   true,
+		"param":    true,
+		"video":    true,
+	}
+)
+
+type ampValidator struct {
+	errs       []error
+	extensions map[string]bool
+	elements   map[string]bool
+	runtime    int
+	canonical  int
+	viewport   int
+	boiler     int
+	noscript   int
+}
+
+func (v *ampValidator) errorf(format string, args ...interface{}) {
+	v.errs = append(v.errs, fmt.Errorf(format, args...))
+}
+
+func attr(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+func text(n *html.Node) string {
+	b := &strings.Builder{}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.TextNode {
+			b.WriteString(c.Data)
+		}
+	}
+	return b.String()
+}
+
+func firstElement(n *html.Node) *html.Node {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode {
+			return c
+		}
+	}
+	return nil
+}
+
+// validateAMP checks page against the vendored AMP rules.
+func validateAMP(page []byte) []error {
+	// Parsing with scripting disabled exposes the content of noscript.
+	doc, err := html.ParseWithOptions(bytes.NewReader(page), html.ParseOptionEnableScripting(false))
+	if err != nil {
+		return []error{err}
+	}
+	v := &ampValidator{
+		extensions: make(map[string]bool),
+		elements:   make(map[string]bool),
+	}
+	if c := doc.FirstChild; c == nil || c.Type != html.DoctypeNode || c.Data != "html" {
+		v.errorf("missing <!doctype html>")
+	}
+	root := firstElement(doc)
+	_, amp := attr(root, "amp")
+	_, bolt := attr(root, "⚡")
+	if !amp && !bolt {
+		v.errorf("html lacks amp attribute")
+	}
+	head := firstElement(root)
+	if head == nil || head.Data != "head" {
+		v.errorf("missing head")
+		return v.errs
+	}
+	if meta := firstElement(head); meta == nil || meta.Data != "meta" {
+		v.errorf("first child of head is not meta charset")
+	} else if charset, _ := attr(meta, "charset"); !strings.EqualFold(charset, "utf-8") {
+		v.errorf("charset is %q, not utf-8", charset)
+	}
+	v.walk(root, head)
+
+	if v.runtime != 1 {
+		v.errorf("AMP runtime is included %d times", v.runtime)
+	}
+	if v.canonical != 1 {
+		v.errorf("%d canonical links", v.canonical)
+	}
+	if v.viewport != 1 {
+		v.errorf("%d viewport meta tags", v.viewport)
+	}
+	if v.boiler != 1 || v.noscript != 1 {
+		v.errorf("missing or duplicate boilerplate")
+	}
+	for name := range v.elements {
+		ext := name
+		if e, ok := validatorExtensions[name]; ok {
+			ext = e
+		}
+		if !validatorBuiltins[name] && !v.extensions[ext] {
+			v.errorf("%s is used without extension %s", name, ext)
+		}
+	}
+	return v.errs
+}
+
+func (v *ampValidator) walk(n, head *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		v.element(c, n, head)
+		v.walk(c, head)
+	}
+}
+
+func inHead(n, head *html.Node) bool {
+	for ; n != nil; n = n.Parent {
+		if n == head {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *ampValidator) element(n, parent, head *html.Node) {
+	if validatorDisallowed[n.Data] {
+		v.errorf("<%s> is disallowed", n.Data)
+	}
+	if strings.HasPrefix(n.Data, "amp-") {
+		v.elements[n.Data] = true
+	}
+	for _, a := range n.Attr {
+		if strings.HasPrefix(a.Key, "on") && a.Key != "on" {
+			v.errorf("<%s> has event handler %s", n.Data, a.Key)
+		}
+		if a.Key == "id" || a.Key == "class" {
+			for _, name := range strings.Fields(a.Val) {
+				if strings.HasPrefix(name, "-amp-") || strings.HasPrefix(name, "i-amp-") {
+					v.errorf("<%s> has reserved %s %q", n.Data, a.Key, name)
+				}
+			}
+		}
+	}
+	switch n.Data {
+	case "script":
+		v.script(n, parent, head)
+	case "style":
+		_, boiler := attr(n, "amp-boilerplate")
+		_, custom := attr(n, "amp-custom")
+		switch {
+		case boiler && parent.Data == "noscript":
+			if text(n) != validatorNoscriptBoilerplate {
+				v.errorf("noscript boilerplate differs")
+			}
+			v.noscript++
+		case boiler:
+			if text(n) != validatorBoilerplate {
+				v.errorf("boilerplate differs")
+			}
+			v.boiler++
+		case !custom:
+			v.errorf("style is neither amp-boilerplate nor amp-custom")
+		}
+		if !inHead(n, head) {
+			v.errorf("style is outside head")
+		}
+	case "link":
+		if rel, _ := attr(n, "rel"); rel == "canonical" {
+			v.canonical++
+			href, _ := attr(n, "href")
+			u, err := url.Parse(href)
+			switch {
+			case err != nil, href == "", strings.HasPrefix(href, "#"):
+				v.errorf("invalid canonical URL %q", href)
+			case u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https":
+				v.errorf("canonical URL scheme %q", u.Scheme)
+			}
+		}
+	case "meta":
+		if name, _ := attr(n, "name"); name == "viewport" {
+			v.viewport++
+			if content, _ := attr(n, "content"); !strings.Contains(content, "width=device-width") {
+				v.errorf("viewport lacks width=device-width")
+			}
+		}
+	case "amp-img":
+		_, src := attr(n, "src")
+		_, srcset := attr(n, "srcset")
+		if !src && !srcset {
+			v.errorf("amp-img lacks src")
+		}
+		layout, _ := attr(n, "layout")
+		_, width := attr(n, "width")
+		_, height := attr(n, "height")
+		switch layout {
+		case "fill", "flex-item", "nodisplay":
+		case "fixed-height":
+			if !height {
+				v.errorf("amp-img with layout %s lacks height", layout)
+			}
+		default:
+			if !width || !height {
+				v.errorf("amp-img with layout %q lacks width or height", layout)
+			}
+		}
+	}
+}
+
+func (v *ampValidator) script(n, parent, head *html.Node) {
+	src, _ := attr(n, "src")
+	typ, _ := attr(n, "type")
+	_, async := attr(n, "async")
+	switch {
+	case src == validatorRuntimeURL:
+		v.runtime++
+		if !async || !inHead(n, head) {
+			v.errorf("AMP runtime is not async in head")
+		}
+	case src != "":
+		m := validatorExtensionURL.FindStringSubmatch(src)
+		name, ok := attr(n, "custom-element")
+		if !ok {
+			name, ok = attr(n, "custom-template")
+		}
+		switch {
+		case m == nil:
+			v.errorf("script %q is not AMP", src)
+		case !ok || name != m[1]:
+			v.errorf("extension script %q lacks custom-element", src)
+		case !async || !inHead(n, head):
+			v.errorf("extension %s is not async in head", name)
+		default:
+			v.extensions[name] = true
+		}
+	case typ == "application/ld+json":
+	case typ == "application/json" && strings.HasPrefix(parent.Data, "amp-"):
+	default:
+		v.errorf("inline script is disallowed")
+	}
+}
+
+func TestValidPages(t *testing.T) {
+	carriers := map[string]Carrier{
+		"pre":       PreCarrier{},
+		"multi":     MultiElementCarrier{ChunkSize: 100},
+		"json":      JSONCarrier{ChunkSize: 100},
+		"attribute": AttributeCarrier{ChunkSize: 100},
+	}
+	for name, carrier := range carriers {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			for _, payload := range [][]byte{nil, bytes.Repeat([]byte("amper"), 100)} {
+				buf := &bytes.Buffer{}
+				enc := NewEncoder(buf)
+				enc.Carrier = carrier
+				enc.CanonicalURL = "https://example.org/v/s/amp.example.org/page?x=<y>"
+				_, err := enc.Write(payload)
+				is.NoErr(err)
+				is.NoErr(enc.CloseWithStatus(500, "<failed>"))
+				is.Equal(validateAMP(buf.Bytes()), nil)
+			}
+			for i := 0; i < 10; i++ {
+				buf := &bytes.Buffer{}
+				enc := NewEncoder(buf)
+				enc.Carrier = carrier
+				enc.Template = RandomTemplates{}
+				enc.Marker = SecretMarker{Secret: []byte("secret")}
+				_, err := enc.Write([]byte("amper"))
+				is.NoErr(err)
+				is.NoErr(enc.Close())
+				is.Equal(validateAMP(buf.Bytes()), nil)
+			}
+		})
+	}
+}
+
+func TestValidatorRejects(t *testing.T) {
+	is := is.New(t)
+	page := func(f func(enc *Encoder)) []byte {
+		buf := &bytes.Buffer{}
+		enc := NewEncoder(buf)
+		f(enc)
+		enc.Close()
+		return buf.Bytes()
+	}
+	is.Equal(validateAMP(page(func(enc *Encoder) {})), nil)
+	is.True(validateAMP(page(func(enc *Encoder) {
+		enc.UseOldBoilerplate = true
+	})) != nil)
+	is.True(validateAMP(page(func(enc *Encoder) {
+		enc.CanonicalURL = "#"
+	})) != nil)
+
+	valid := page(func(enc *Encoder) {})
+	for _, edit := range []struct{ old, new string }{
+		{`<meta charset="utf-8">`, ``},
+		{`<html amp>`, `<html>`},
+		{`<pre id="data">`, `<pre id="data"><script>alert(1)</script>`},
+		{`<pre id="data">`, `<amp-state id="s"></amp-state><pre id="data">`},
+		{`<pre id="data">`, `<img src="x.png"><pre id="data">`},
+		{`<pre id="data">`, `<pre id="data" onclick="f()">`},
+	} {
+		invalid := strings.Replace(string(valid), edit.old, edit.new, 1)
+		is.True(validateAMP([]byte(invalid)) != nil) // edit.new must be rejected
+	}
+}
@@ -0,0 +1,258 @@
+// encoder.go - GET request encoding which hides data length.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of amper, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package getcodec
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	mathrand "math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// DefaultMinSlugLength is the default least length of random slugs.
+	DefaultMinSlugLength = 8
+	// DefaultMaxSlugLength is the default greatest length of random slugs.
+	DefaultMaxSlugLength = 24
+)
+
+// MaxDecompressedSize limits the size of decompressed data.
+const MaxDecompressedSize = 1 << 20
+
+// headerDeflate is the flag of the header byte
+// of data compressed with DEFLATE.
+const headerDeflate = 1
+
+var (
+	// ErrInvalidPayload designates that the payload of the path is malformed.
+	ErrInvalidPayload = errors.New("invalid payload")
+	// ErrTooLarge designates that data decompresses
+	// to more than MaxDecompressedSize bytes.
+	ErrTooLarge = errors.New("decompressed data is too large")
+)
+
+// EncoderConfig configures encoding of data into URL paths which hide
+// the length of data. The paths have the format
+// "/{random}/[{fragment}/]{segment}/.../{segment}.{count}", where
+// count is the number of segments, and the segments joined carry
+// the URL-safe Base64 of the payload. The payload is the header byte,
+// the uvarint length of data, data, and random padding. The header
+// byte flags data compressed with DEFLATE.
+// Paths in Styles carry the same payload in other layouts.
+// Decode accepts all these paths and the ones of Encode.
+type EncoderConfig struct {
+	// Buckets are the payload sizes in increasing order. Payload is
+	// padded to the smallest bucket which fits it, and payload larger
+	// than all buckets is padded to a multiple of the largest one.
+	// If empty, payload is not padded.
+	Buckets []int
+	// MinSlugLength is the least length of random slugs.
+	// Defaults to DefaultMinSlugLength.
+	MinSlugLength int
+	// MaxSlugLength is the greatest length of random slugs.
+	// Defaults to DefaultMaxSlugLength.
+	MaxSlugLength int
+	// SegmentLength is the greatest length of the segments carrying
+	// payload. Segments are of random lengths from half of it up to it.
+	// If zero, payload is carried in a single segment.
+	SegmentLength int
+	// Compress makes payload compressed with DEFLATE
+	// unless it gets no shorter.
+	Compress bool
+	// Styles are the styles of paths, which make them look like
+	// the ones of real sites. Paths rotate through them in order.
+	// Payload of styled paths is carried in a single segment or query
+	// parameter regardless of SegmentLength. If empty, paths are
+	// in the format above.
+	Styles []PathStyle
+
+	styleIndex uint32
+}
+
+// randomBetween returns a random integer in [min, max].
+func randomBetween(min, max int) int {
+	if max <= min {
+		return min
+	}
+	return min + mathrand.Intn(max-min+1)
+}
+
+func (cfg *EncoderConfig) slug() string {
+	minLength := cfg.MinSlugLength
+	if minLength == 0 {
+		minLength = DefaultMinSlugLength
+	}
+	maxLength := cfg.MaxSlugLength
+	if maxLength == 0 {
+		maxLength = max(DefaultMaxSlugLength, minLength)
+	}
+	return randomSlug(randomBetween(minLength, maxLength))
+}
+
+// paddedSize returns the size of payload of size n with padding.
+func (cfg *EncoderConfig) paddedSize(n int) int {
+	if len(cfg.Buckets) == 0 {
+		return n
+	}
+	for _, size := range cfg.Buckets {
+		if size >= n {
+			return size
+		}
+	}
+	largest := cfg.Buckets[len(cfg.Buckets)-1]
+	if largest <= 0 {
+		return n
+	}
+	return (n + largest - 1) / largest * largest
+}
+
+// payload returns the URL-safe Base64 of the payload carrying data.
+func (cfg *EncoderConfig) payload(data []byte) (string, error) {
+	header := byte(0)
+	if cfg.Compress {
+		compressed, err := deflate(data)
+		if err != nil {
+			return "", err
+		}
+		// Compression does not help short or random data.
+		if len(compressed) < len(data) {
+			header |= headerDeflate
+			data = compressed
+		}
+	}
+	b := []byte{header}
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	b = append(b, data...)
+	padding := make([]byte, cfg.paddedSize(len(b))-len(b))
+	if _, err := io.ReadFull(rand.Reader, padding); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(append(b, padding...)), nil
+}
+
+// segments spreads payload s across path segments.
+func (cfg *EncoderConfig) segments(s string) string {
+	var segments []string
+	for len(s) > 0 {
+		n := len(s)
+		if cfg.SegmentLength > 0 {
+			n = min(n, randomBetween((cfg.SegmentLength+1)/2, cfg.SegmentLength))
+		}
+		segments = append(segments, s[:n])
+		s = s[n:]
+	}
+	return strings.Join(segments, "/") + "." + strconv.Itoa(len(segments))
+}
+
+// style returns the style of the next path, or nil for the default one.
+func (cfg *EncoderConfig) style() PathStyle {
+	if len(cfg.Styles) == 0 {
+		return nil
+	}
+	i := atomic.AddUint32(&cfg.styleIndex, 1) - 1
+	return cfg.Styles[int(i)%len(cfg.Styles)]
+}
+
+// path returns the path of fragment f carrying data.
+// The fragment is nil if the message is not fragmented.
+func (cfg *EncoderConfig) path(f *Fragment, data []byte) (string, error) {
+	payload, err := cfg.payload(data)
+	if err != nil {
+		return "", err
+	}
+	parts := &PathParts{
+		Slug:    cfg.slug(),
+		Payload: payload,
+	}
+	if f != nil {
+		parts.Fragment = f.String()
+	}
+	if style := cfg.style(); style != nil {
+		return style.Encode(parts), nil
+	}
+	p := parts.Slug + "/"
+	if f != nil {
+		p += parts.Fragment + "/"
+	}
+	return p + cfg.segments(payload), nil
+}
+
+// Encode encodes data from reader r into URL path.
+func (cfg *EncoderConfig) Encode(r io.Reader) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return cfg.path(nil, data)
+}
+
+// EncodeFragments encodes data from reader r into URL paths
+// of fragments, each carrying at most size bytes of data.
+func (cfg *EncoderConfig) EncodeFragments(r io.Reader, size int) ([]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return fragments(data, size, cfg.path)
+}
+
+// decodePayload decodes data from the payload of segments.
+func decodePayload(segments []string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.Join(segments, ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 || b[0]&^headerDeflate != 0 {
+		return nil, ErrInvalidPayload
+	}
+	size, n := binary.Uvarint(b[1:])
+	if n <= 0 || size > uint64(len(b)-1-n) {
+		return nil, ErrInvalidPayload
+	}
+	data := b[1+n : 1+n+int(size)]
+	if b[0]&headerDeflate != 0 {
+		return inflate(data)
+	}
+	return data, nil
+}
+
+func deflate(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, err := flate.NewWriter(buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// inflate decompresses data of at most MaxDecompressedSize bytes.
+func inflate(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	b, err := io.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+	if err != nil {
+		return nil, ErrInvalidPayload
+	}
+	if len(b) > MaxDecompressedSize {
+		return nil, ErrTooLarge
+	}
+	return b, nil
+}
@@ -11,19 +11,87 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"net/url"
 	"path"
+	"strconv"
 	"strings"
 )
 
-// Produce a random ID as a URL-safe Base64 string.
-func randomID() string {
-	b := make([]byte, 10)
+// MaxFragments is the maximum number of fragments in a message.
+const MaxFragments = 1024
+
+var (
+	// ErrTooManyFragments designates that the message does not fit
+	// into MaxFragments fragments.
+	ErrTooManyFragments = errors.New("too many fragments")
+	// ErrInvalidFragment designates that the fragment header is malformed.
+	ErrInvalidFragment = errors.New("invalid fragment")
+)
+
+// Fragment describes the position of a fragment in a message.
+type Fragment struct {
+	// ID is the message ID shared by all its fragments.
+	ID uint64
+	// Index is the index of the fragment.
+	Index int
+	// Count is the total number of fragments in the message.
+	Count int
+}
+
+func (f *Fragment) String() string {
+	var id [8]byte
+	binary.BigEndian.PutUint64(id[:], f.ID)
+	return fmt.Sprintf("%s.%d.%d", hex.EncodeToString(id[:]), f.Index, f.Count)
+}
+
+// parseFragment parses fragment header s. As URL-safe Base64
+// never contains dots, s is not confused with a payload.
+func parseFragment(s string) (*Fragment, error) {
+	sp := strings.Split(s, ".")
+	if len(sp) != 3 {
+		return nil, ErrInvalidFragment
+	}
+	id, err := hex.DecodeString(sp[0])
+	if err != nil || len(id) != 8 {
+		return nil, ErrInvalidFragment
+	}
+	index, err := strconv.Atoi(sp[1])
+	if err != nil {
+		return nil, ErrInvalidFragment
+	}
+	count, err := strconv.Atoi(sp[2])
+	if err != nil {
+		return nil, ErrInvalidFragment
+	}
+	if count < 1 || count > MaxFragments || index < 0 || index >= count {
+		return nil, ErrInvalidFragment
+	}
+	f := &Fragment{
+		ID:    binary.BigEndian.Uint64(id),
+		Index: index,
+		Count: count,
+	}
+	return f, nil
+}
+
+// randomSlug returns a random URL-safe Base64 string of length n.
+func randomSlug(n int) string {
+	b := make([]byte, (n*3+3)/4)
 	_, err := io.ReadFull(rand.Reader, b)
 	if err != nil {
 		panic(err)
 	}
-	return base64.RawURLEncoding.EncodeToString(b)
+	return base64.RawURLEncoding.EncodeToString(b)[:n]
+}
+
+// Produce a random ID as a URL-safe Base64 string.
+func randomID() string {
+	return randomSlug(14)
 }
 
 // Encode encodes data from reader r into URL path.
@@ -40,10 +108,183 @@ func Encode(r io.Reader) (string, error) {
 	return path.Join(slug, req), nil
 }
 
-// Decode decodes request data from the path.
+// EncodeFragments encodes data from reader r into URL paths
+// of fragments, each carrying at most size bytes of data.
+// The format is "/{random}/{id}.{index}.{count}/{payload}" where
+// id is the hex-encoded message ID, and index and count are
+// the fragment index and the number of fragments.
+func EncodeFragments(r io.Reader, size int) ([]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return fragments(data, size, func(f *Fragment, chunk []byte) (string, error) {
+		req := base64.RawURLEncoding.EncodeToString(chunk)
+		return path.Join(randomID(), f.String(), req), nil
+	})
+}
+
+// fragments splits data into fragments of at most size bytes
+// and returns their paths made by encode.
+func fragments(data []byte, size int, encode func(f *Fragment, chunk []byte) (string, error)) ([]string, error) {
+	count := (len(data) + size - 1) / size
+	if count == 0 {
+		count = 1
+	}
+	if count > MaxFragments {
+		return nil, ErrTooManyFragments
+	}
+	var id [8]byte
+	_, err := io.ReadFull(rand.Reader, id[:])
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, count)
+	for i := range paths {
+		f := &Fragment{
+			ID:    binary.BigEndian.Uint64(id[:]),
+			Index: i,
+			Count: count,
+		}
+		chunk := data[min(i*size, len(data)):min((i+1)*size, len(data))]
+		paths[i], err = encode(f, chunk)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// parsedPath is a path split into its parts.
+type parsedPath struct {
+	slug     string
+	fragment string
+	payload  []string
+	// legacy designates the format of Encode.
+	legacy bool
+	// style is the style of the path, if any.
+	style PathStyle
+}
+
+// parsePath splits path p, which may be followed by query,
+// into its parts. The path is either in a registered style
+// or in the format of Encode or EncoderConfig.
+func parsePath(p string) (*parsedPath, error) {
+	u, err := url.Parse(p)
+	if err != nil {
+		return nil, ErrInvalidPayload
+	}
+	if parts, style := decodeStyled(u); style != nil {
+		pp := &parsedPath{
+			slug:     parts.Slug,
+			fragment: parts.Fragment,
+			payload:  []string{parts.Payload},
+			style:    style,
+		}
+		return pp, nil
+	}
+	sp := strings.Split(u.Path, "/")
+	last := sp[len(sp)-1]
+	pp := &parsedPath{}
+	if i := strings.LastIndexByte(last, '.'); i < 0 {
+		pp.legacy = true
+		pp.payload = sp[len(sp)-1:]
+	} else {
+		count, err := strconv.Atoi(last[i+1:])
+		if err != nil || count < 1 || count > len(sp) {
+			return nil, ErrInvalidPayload
+		}
+		rest := sp[len(sp)-count : len(sp)-1 : len(sp)-1]
+		pp.payload = append(rest, last[:i])
+	}
+	sp = sp[:len(sp)-len(pp.payload)]
+	if n := len(sp); n > 0 && strings.Contains(sp[n-1], ".") {
+		pp.fragment = sp[n-1]
+		sp = sp[:n-1]
+	}
+	if n := len(sp); n > 0 {
+		pp.slug = sp[n-1]
+	}
+	return pp, nil
+}
+
+func (pp *parsedPath) data() ([]byte, error) {
+	if pp.legacy {
+		return base64.RawURLEncoding.DecodeString(pp.payload[0])
+	}
+	return decodePayload(pp.payload)
+}
+
+// DecodeFragment decodes request data from the path along with
+// the fragment header. The returned Fragment is nil if the path
+// is not a fragment.
+func DecodeFragment(path string) (*bytes.Reader, *Fragment, error) {
+	pp, err := parsePath(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var f *Fragment
+	if pp.fragment != "" {
+		f, err = parseFragment(pp.fragment)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	b, err := pp.data()
+	if err != nil {
+		return nil, nil, err
+	}
+	return bytes.NewReader(b), f, nil
+}
+
+// ParseFragment returns the fragment header of the path
+// without decoding its data. It returns nil if the path
+// is not a fragment.
+func ParseFragment(path string) (*Fragment, error) {
+	pp, err := parsePath(path)
+	if err != nil || pp.fragment == "" {
+		return nil, err
+	}
+	return parseFragment(pp.fragment)
+}
+
+// Reslug replaces the random string of path p produced by
+// Encode or EncodeFragments with a fresh one of the same length,
+// so that the request is not served from cache when repeated.
+// Styled paths are encoded anew in their style.
+func Reslug(p string) string {
+	if pp, err := parsePath(p); err == nil && pp.style != nil {
+		return pp.style.Encode(&PathParts{
+			Slug:     randomID(),
+			Fragment: pp.fragment,
+			Payload:  pp.payload[0],
+		})
+	}
+	i := strings.Index(p, "/")
+	if i < 0 {
+		return p
+	}
+	return randomSlug(i) + p[i:]
+}
+
+// Slug returns the random string of path p, which identifies
+// the request. It returns empty string if there is none.
+func Slug(p string) string {
+	pp, err := parsePath(p)
+	if err != nil {
+		return ""
+	}
+	return pp.slug
+}
+
+// Decode decodes request data from the path,
+// which may be followed by query.
 func Decode(path string) (*bytes.Reader, error) {
-	sp := strings.Split(path, "/")
-	b, err := base64.RawURLEncoding.DecodeString(sp[len(sp)-1])
+	pp, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	b, err := pp.data()
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,249 @@
+package getcodec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	is := is.New(t)
+	input := []byte("hello, amper")
+	p, err := Encode(bytes.NewReader(input))
+	is.NoErr(err)
+	r, err := Decode(p)
+	is.NoErr(err)
+	output, err := io.ReadAll(r)
+	is.NoErr(err)
+	is.Equal(output, input)
+
+	r, f, err := DecodeFragment(p)
+	is.NoErr(err)
+	is.True(f == nil)
+	output, err = io.ReadAll(r)
+	is.NoErr(err)
+	is.Equal(output, input)
+}
+
+func TestFragments(t *testing.T) {
+	is := is.New(t)
+	input := bytes.Repeat([]byte("abc"), 10)
+	paths, err := EncodeFragments(bytes.NewReader(input), 7)
+	is.NoErr(err)
+	is.Equal(len(paths), 5)
+
+	var output []byte
+	var id uint64
+	for i, p := range paths {
+		r, f, err := DecodeFragment(p)
+		is.NoErr(err)
+		is.Equal(f.Index, i)
+		is.Equal(f.Count, len(paths))
+		if i == 0 {
+			id = f.ID
+		}
+		is.Equal(f.ID, id)
+		pf, err := ParseFragment(p)
+		is.NoErr(err)
+		is.Equal(pf, f)
+		b, err := io.ReadAll(r)
+		is.NoErr(err)
+		output = append(output, b...)
+	}
+	is.Equal(output, input)
+
+	_, err = EncodeFragments(bytes.NewReader(make([]byte, MaxFragments+1)), 1)
+	is.Equal(err, ErrTooManyFragments)
+}
+
+func TestInvalidFragment(t *testing.T) {
+	is := is.New(t)
+	for _, p := range []string{
+		"slug/0011223344556677.2.2/AA",
+		"slug/0011223344556677.0.0/AA",
+		"slug/00112233.0.1/AA",
+		"slug/0011223344556677.x.1/AA",
+	} {
+		_, _, err := DecodeFragment(p)
+		is.Equal(err, ErrInvalidFragment)
+	}
+}
+
+func TestReslug(t *testing.T) {
+	is := is.New(t)
+	p, err := Encode(bytes.NewReader([]byte("hello")))
+	is.NoErr(err)
+	p2 := Reslug(p)
+	is.True(p2 != p)
+	is.Equal(strings.SplitN(p2, "/", 2)[1], strings.SplitN(p, "/", 2)[1])
+	is.Equal(len(p2), len(p))
+}
+
+func TestSlug(t *testing.T) {
+	is := is.New(t)
+	p, err := Encode(bytes.NewReader([]byte("hello")))
+	is.NoErr(err)
+	slug := strings.Split(p, "/")[0]
+	is.Equal(Slug("/prefix/"+p), slug)
+
+	paths, err := EncodeFragments(bytes.NewReader([]byte("hello")), 2)
+	is.NoErr(err)
+	is.Equal(Slug(paths[1]), strings.Split(paths[1], "/")[0])
+	is.Equal(Slug("payload"), "")
+}
+
+func TestEncoderConfig(t *testing.T) {
+	is := is.New(t)
+	cfg := &EncoderConfig{
+		Buckets:       []int{64, 256},
+		MinSlugLength: 12,
+		MaxSlugLength: 12,
+		SegmentLength: 16,
+	}
+	lengths := map[int]bool{}
+	for _, n := range []int{0, 1, 10, 60} {
+		input := bytes.Repeat([]byte("a"), n)
+		p, err := cfg.Encode(bytes.NewReader(input))
+		is.NoErr(err)
+		pp, err := parsePath(p)
+		is.NoErr(err)
+		lengths[len(strings.Join(pp.payload, ""))] = true
+		is.True(strings.Count(p, "/") > 4) // payload is spread across segments
+		r, err := Decode("/prefix/" + p)
+		is.NoErr(err)
+		output, err := io.ReadAll(r)
+		is.NoErr(err)
+		is.Equal(output, input)
+		is.Equal(Slug("/prefix/"+p), strings.Split(p, "/")[0])
+		is.Equal(len(Slug(p)), 12)
+		is.Equal(Slug(Reslug(p)) != Slug(p), true)
+	}
+	is.Equal(len(lengths), 1) // all payloads fit the smallest bucket
+
+	cfg = &EncoderConfig{SegmentLength: 4}
+	input := bytes.Repeat([]byte("abc"), 10)
+	paths, err := cfg.EncodeFragments(bytes.NewReader(input), 7)
+	is.NoErr(err)
+	is.Equal(len(paths), 5)
+	var output []byte
+	for i, p := range paths {
+		slug := strings.Split(p, "/")[0]
+		is.True(len(slug) >= DefaultMinSlugLength && len(slug) <= DefaultMaxSlugLength)
+		is.Equal(Slug(p), slug)
+		r, f, err := DecodeFragment(p)
+		is.NoErr(err)
+		is.Equal(f.Index, i)
+		pf, err := ParseFragment(p)
+		is.NoErr(err)
+		is.Equal(pf, f)
+		b, err := io.ReadAll(r)
+		is.NoErr(err)
+		output = append(output, b...)
+	}
+	is.Equal(output, input)
+
+	for _, p := range []string{
+		"slug/AA.x",
+		"slug/AA.3",
+		"slug/AQA.1", // unknown header byte
+		"slug/AAU.1", // data is shorter than its length
+		"slug/AA.0",
+	} {
+		_, err := Decode(p)
+		is.True(err != nil)
+	}
+}
+
+func TestPathStyles(t *testing.T) {
+	is := is.New(t)
+	cfg := &EncoderConfig{
+		Buckets: []int{64},
+		Styles:  []PathStyle{NewsStyle{}, CategoryStyle{}},
+	}
+	input := bytes.Repeat([]byte("abc"), 10)
+	for i := 0; i < 4; i++ {
+		p, err := cfg.Encode(bytes.NewReader(input))
+		is.NoErr(err)
+		if i%2 == 0 {
+			is.True(strings.HasSuffix(p, ".amp.html"))
+		} else {
+			is.True(strings.Contains(p, ".html?id="))
+		}
+		r, err := Decode("/v/s/example.org/" + p)
+		is.NoErr(err)
+		output, err := io.ReadAll(r)
+		is.NoErr(err)
+		is.Equal(output, input)
+		slug := Slug(p)
+		is.True(slug != "")
+		is.Equal(Slug("/v/s/example.org/"+p), slug)
+
+		p2 := Reslug(p)
+		is.True(Slug(p2) != slug)
+		r, err = Decode(p2)
+		is.NoErr(err)
+		output, err = io.ReadAll(r)
+		is.NoErr(err)
+		is.Equal(output, input)
+	}
+
+	paths, err := cfg.EncodeFragments(bytes.NewReader(input), 7)
+	is.NoErr(err)
+	var output []byte
+	for i, p := range paths {
+		r, f, err := DecodeFragment(p)
+		is.NoErr(err)
+		is.Equal(f.Index, i)
+		b, err := io.ReadAll(r)
+		is.NoErr(err)
+		output = append(output, b...)
+	}
+	is.Equal(output, input)
+
+	// Paths of other formats are not taken for styled ones.
+	p, err := Encode(bytes.NewReader(input))
+	is.NoErr(err)
+	is.Equal(Slug("/news/2026/10/"+p), strings.Split(p, "/")[0])
+}
+
+func TestCompress(t *testing.T) {
+	is := is.New(t)
+	cfg := &EncoderConfig{Compress: true}
+	input := bytes.Repeat([]byte("hello, amper "), 100)
+	p, err := cfg.Encode(bytes.NewReader(input))
+	is.NoErr(err)
+	plain, err := (&EncoderConfig{}).Encode(bytes.NewReader(input))
+	is.NoErr(err)
+	is.True(len(p) < len(plain)/4)
+	r, err := Decode(p)
+	is.NoErr(err)
+	output, err := io.ReadAll(r)
+	is.NoErr(err)
+	is.Equal(output, input)
+
+	// Data which compression does not help is left as is.
+	input = []byte("amper")
+	p, err = cfg.Encode(bytes.NewReader(input))
+	is.NoErr(err)
+	pp, err := parsePath(p)
+	is.NoErr(err)
+	is.Equal(pp.payload[0][:2], "AA")
+	r, err = Decode(p)
+	is.NoErr(err)
+	output, err = io.ReadAll(r)
+	is.NoErr(err)
+	is.Equal(output, input)
+
+	// Decompression bombs are rejected.
+	bomb, err := deflate(make([]byte, MaxDecompressedSize+1))
+	is.NoErr(err)
+	b := binary.AppendUvarint([]byte{headerDeflate}, uint64(len(bomb)))
+	p = "slug/" + base64.RawURLEncoding.EncodeToString(append(b, bomb...)) + ".1"
+	_, err = Decode(p)
+	is.Equal(err, ErrTooLarge)
+}
@@ -0,0 +1,188 @@
+// style.go - styles of GET request paths.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of amper, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package getcodec
+
+import (
+	"fmt"
+	mathrand "math/rand"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PathParts are the parts of request carried by a path.
+type PathParts struct {
+	// Slug is the random string which disables cache.
+	Slug string
+	// Fragment is the fragment header, or empty
+	// if the message is not fragmented.
+	Fragment string
+	// Payload is the URL-safe Base64 of the payload.
+	Payload string
+}
+
+// PathStyle is a style of paths which look like the ones of real
+// sites, e.g. news articles, while carrying request parts.
+type PathStyle interface {
+	// Encode returns the path, optionally followed by query,
+	// which carries parts.
+	Encode(parts *PathParts) string
+	// Decode returns the parts carried by the path and query of u,
+	// or nil if u is not of the style.
+	Decode(u *url.URL) *PathParts
+}
+
+var (
+	stylesMutex sync.RWMutex
+	styles      []PathStyle
+)
+
+// RegisterPathStyle registers style, so that Decode, DecodeFragment
+// and Slug recognize its paths. NewsStyle and CategoryStyle
+// are registered by default.
+func RegisterPathStyle(style PathStyle) {
+	stylesMutex.Lock()
+	defer stylesMutex.Unlock()
+	styles = append(styles, style)
+}
+
+func init() {
+	RegisterPathStyle(NewsStyle{})
+	RegisterPathStyle(CategoryStyle{})
+}
+
+// decodeStyled returns the parts of u carried in a registered style
+// along with the style. The style is nil if no style matches.
+func decodeStyled(u *url.URL) (*PathParts, PathStyle) {
+	stylesMutex.RLock()
+	defer stylesMutex.RUnlock()
+	for _, style := range styles {
+		if parts := style.Decode(u); parts != nil {
+			return parts, style
+		}
+	}
+	return nil, nil
+}
+
+var (
+	styleSections = []string{
+		"news", "world", "business", "tech", "science", "culture", "sport", "travel",
+	}
+	styleCategories = []string{
+		"recipes", "gardening", "diy", "health", "books", "music", "photography", "cycling",
+	}
+	styleWords = []string{
+		"how", "why", "new", "best", "guide", "tips", "city", "local", "report",
+		"market", "plan", "season", "week", "review", "update", "story", "year",
+		"home", "family", "team", "future", "change", "small", "simple", "green",
+	}
+)
+
+func pickWord(s []string) string {
+	return s[mathrand.Intn(len(s))]
+}
+
+// title returns a title slug of random words.
+func title() string {
+	words := make([]string, 2+mathrand.Intn(4))
+	for i := range words {
+		words[i] = pickWord(styleWords)
+	}
+	return strings.Join(words, "-")
+}
+
+// isWord tells whether s is a non-empty lowercase word.
+func isWord(s string) bool {
+	for _, c := range s {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// isNumber tells whether s is a number of n digits.
+func isNumber(s string, n int) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(s) == n
+}
+
+const newsSuffix = ".amp.html"
+
+// NewsStyle is the style of dated news articles,
+// "/{section}/{year}/{month}/{title}-{slug}/[{fragment}/]{payload}.amp.html".
+type NewsStyle struct{}
+
+func (NewsStyle) Encode(parts *PathParts) string {
+	date := time.Now().AddDate(0, 0, -mathrand.Intn(365))
+	p := fmt.Sprintf("%s/%04d/%02d/%s-%s/", pickWord(styleSections),
+		date.Year(), date.Month(), title(), parts.Slug)
+	if parts.Fragment != "" {
+		p += parts.Fragment + "/"
+	}
+	return p + parts.Payload + newsSuffix
+}
+
+func (NewsStyle) Decode(u *url.URL) *PathParts {
+	sp := strings.Split(u.Path, "/")
+	n := len(sp)
+	if n < 5 || !strings.HasSuffix(sp[n-1], newsSuffix) {
+		return nil
+	}
+	parts := &PathParts{
+		Payload: strings.TrimSuffix(sp[n-1], newsSuffix),
+	}
+	sp = sp[:n-1]
+	if strings.Contains(sp[len(sp)-1], ".") {
+		parts.Fragment = sp[len(sp)-1]
+		sp = sp[:len(sp)-1]
+	}
+	n = len(sp)
+	if n < 4 || !isWord(sp[n-4]) || !isNumber(sp[n-3], 4) || !isNumber(sp[n-2], 2) {
+		return nil
+	}
+	parts.Slug = sp[n-1]
+	return parts
+}
+
+// CategoryStyle is the style of categorized pages, which carry
+// payload in query, "/{category}/{title}-{slug}.html?id={payload}",
+// with the fragment header in the "part" query parameter.
+type CategoryStyle struct{}
+
+func (CategoryStyle) Encode(parts *PathParts) string {
+	query := url.Values{}
+	query.Set("id", parts.Payload)
+	if parts.Fragment != "" {
+		query.Set("part", parts.Fragment)
+	}
+	return fmt.Sprintf("%s/%s-%s.html?%s", pickWord(styleCategories),
+		title(), parts.Slug, query.Encode())
+}
+
+func (CategoryStyle) Decode(u *url.URL) *PathParts {
+	query := u.Query()
+	if !query.Has("id") {
+		return nil
+	}
+	sp := strings.Split(u.Path, "/")
+	n := len(sp)
+	if n < 2 || !isWord(sp[n-2]) || !strings.HasSuffix(sp[n-1], ".html") {
+		return nil
+	}
+	return &PathParts{
+		Slug:     strings.TrimSuffix(sp[n-1], ".html"),
+		Fragment: query.Get("part"),
+		Payload:  query.Get("id"),
+	}
+}
@@ -0,0 +1,154 @@
+// dial.go - client side of amper stream sessions.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of amper, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package amper
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// sessionMaxUpstream is the maximum size of data in
+	// a single upstream segment. It is bounded by the URL length.
+	sessionMaxUpstream = 1500
+	// sessionMinPollInterval and sessionMaxPollInterval bound
+	// the interval between polls of an idle session.
+	sessionMinPollInterval = 50 * time.Millisecond
+	sessionMaxPollInterval = 2 * time.Second
+	// sessionRequestTimeout is the timeout of a single round trip.
+	sessionRequestTimeout = 30 * time.Second
+	// sessionMaxFailures is the number of consecutive failed
+	// round trips after which the session is aborted.
+	sessionMaxFailures = 8
+)
+
+type clientConn struct {
+	*stream
+	client *Client
+	id     sessionID
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Dial establishes a stream session with the Listener behind the
+// server c points to. The session is carried by repeated round trips
+// of c, and the returned net.Conn polls the server in background
+// until it is closed. ctx is used only for establishing the session.
+func Dial(ctx context.Context, c *Client) (net.Conn, error) {
+	id := newSessionID()
+	pctx, cancel := context.WithCancel(context.Background())
+	conn := &clientConn{
+		stream: newStream(Addr(id.String()), Addr(c.Host)),
+		client: c,
+		id:     id,
+		ctx:    pctx,
+		cancel: cancel,
+	}
+	established := make(chan struct{})
+	go conn.poll(established)
+	select {
+	case <-established:
+		return conn, nil
+	case <-conn.done:
+		cancel()
+		return nil, conn.failure()
+	case <-ctx.Done():
+		err := &CanceledError{Err: ctx.Err()}
+		conn.fail(err)
+		cancel()
+		return nil, err
+	}
+}
+
+func (c *clientConn) roundTrip(seg *segment) (*segment, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, sessionRequestTimeout)
+	defer cancel()
+	resp, err := c.client.RoundTripContext(ctx, bytes.NewReader(seg.marshalRequest()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+	b, err := io.ReadAll(resp)
+	if err != nil {
+		return nil, err
+	}
+	return parseResponse(b)
+}
+
+// poll exchanges segments with the server until the session
+// is finished or aborted. It closes established after the first
+// successful exchange.
+func (c *clientConn) poll(established chan struct{}) {
+	defer c.cancel()
+	interval := sessionMinPollInterval
+	failures := 0
+	for {
+		seq, data, fin := c.outgoing(sessionMaxUpstream)
+		seg := &segment{
+			id:   c.id,
+			seq:  seq,
+			ack:  c.ackNumber(),
+			data: data,
+		}
+		if established != nil {
+			seg.flags |= flagSYN
+		}
+		if fin {
+			seg.flags |= flagFIN
+		}
+		resp, err := c.roundTrip(seg)
+		if err != nil {
+			if c.ctx.Err() != nil || c.failure() != nil {
+				return
+			}
+			failures++
+			if failures == sessionMaxFailures {
+				c.fail(err)
+				return
+			}
+			interval = min(2*interval, sessionMaxPollInterval)
+			select {
+			case <-time.After(interval):
+			case <-c.ctx.Done():
+				return
+			}
+			continue
+		}
+		failures = 0
+		if resp.flags&flagRST != 0 {
+			c.fail(ErrSessionReset)
+			return
+		}
+		if established != nil {
+			close(established)
+			established = nil
+		}
+		acked := c.acknowledge(resp.ack)
+		delivered := c.deliver(resp.seq, resp.data, resp.flags&flagFIN != 0)
+		if c.finished() {
+			return
+		}
+		if acked || delivered {
+			interval = sessionMinPollInterval
+		} else {
+			interval = min(2*interval, sessionMaxPollInterval)
+		}
+		if acked && c.hasOutgoing() {
+			continue
+		}
+		select {
+		case <-c.pending:
+		case <-time.After(interval):
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
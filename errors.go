@@ -0,0 +1,173 @@
+// errors.go - amper errors.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of amper, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package amper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// maxErrorBodySize limits the response body excerpt in StatusError.
+const maxErrorBodySize = 512
+
+var (
+	// ErrUnsupportedScheme designates that Client.Scheme is
+	// neither "https" nor "http".
+	ErrUnsupportedScheme = errors.New("unsupported scheme")
+	// ErrSessionReset designates that the session is unknown to
+	// or was dropped by the peer.
+	ErrSessionReset = errors.New("session reset")
+	// ErrSessionTimeout designates that the session was dropped
+	// because it was idle for too long.
+	ErrSessionTimeout = errors.New("session timed out")
+	// ErrFragmentBufferFull designates that there is no room
+	// for the fragment in the reassembly buffer.
+	ErrFragmentBufferFull = errors.New("fragment buffer is full")
+	// ErrFragmentMismatch designates that the fragment does not
+	// agree with the other fragments of its message.
+	ErrFragmentMismatch = errors.New("fragment mismatch")
+	// ErrFragmentDelivered designates that the message of the fragment
+	// was already reassembled and handled.
+	ErrFragmentDelivered = errors.New("fragmented message is already delivered")
+	// ErrProfileFronts designates that one of several CDN profiles
+	// has no fronts of its own to be reached through.
+	ErrProfileFronts = errors.New("CDN profile has no fronts of its own")
+	// ErrNotPage designates that the CDN replied with something
+	// else than an HTML page.
+	ErrNotPage = errors.New("response is not an HTML page")
+	// ErrNoStatus designates that the page carries no in-band status
+	// while Client.RequireStatus is set.
+	ErrNoStatus = errors.New("no status in the page")
+)
+
+// CanceledError is returned when a round trip is aborted because
+// its context was canceled or its deadline was exceeded.
+// Err is either context.Canceled or context.DeadlineExceeded.
+type CanceledError struct {
+	Err error
+}
+
+func (e *CanceledError) Error() string {
+	return "round trip canceled: " + e.Err.Error()
+}
+
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+// StatusError is returned when the CDN replies with an HTTP status
+// that does not carry a page.
+type StatusError struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// Front is the front the request was sent via.
+	Front string
+	// Host is the host the request was sent to.
+	Host string
+	// Body is an excerpt of the response body.
+	Body []byte
+	// Location is the location the CDN redirects to, if any.
+	Location string
+}
+
+// NewStatusError creates a StatusError from resp, reading
+// an excerpt of its body.
+func NewStatusError(resp *http.Response) *StatusError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		Body:       body,
+	}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("http status code %d from %s via %q", e.StatusCode, e.Host, e.Front)
+}
+
+// TransportError is returned when the request fails to get a response
+// from the CDN, e.g. because the front is blocked.
+type TransportError struct {
+	// Front is the front the request was sent via.
+	Front string
+	// Host is the host the request was sent to.
+	Host string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("request to %s via %q: %v", e.Host, e.Front, e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// DecodeError is returned when the response page cannot be decoded,
+// e.g. because the page was served by something else than amper server.
+// Err is usually ampcodec.ErrNoDataElement,
+// ampcodec.ErrMalformedPayload, ampcodec.ErrTooLarge,
+// ErrNotPage or ErrNoStatus.
+type DecodeError struct {
+	// Front is the front the request was sent via.
+	Front string
+	// Host is the host the request was sent to.
+	Host string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decode response from %s via %q: %v", e.Host, e.Front, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// ServerError is returned when amper server replies with
+// an in-band error status.
+type ServerError struct {
+	// StatusCode is the in-band status code, which has
+	// the same meaning as HTTP status codes.
+	StatusCode int
+	// Message is the error message from the server.
+	Message string
+	// Front is the front the request was sent via.
+	Front string
+	// Host is the host the request was sent to.
+	Host string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server status %d from %s via %q: %s", e.StatusCode, e.Host, e.Front, e.Message)
+}
+
+// PublicError is an error of Handler whose Message is sent to the
+// client in the page. The messages of other errors of Handler are
+// not sent, as the pages are cached by the CDN.
+type PublicError struct {
+	// Message is the message sent to the client.
+	Message string
+}
+
+func (e *PublicError) Error() string {
+	return e.Message
+}
+
+// contextError replaces err with a *CanceledError if ctx is done,
+// as in that case err is merely a consequence of the cancellation.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return &CanceledError{Err: ctxErr}
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+// fragment.go - reassembly of fragmented requests.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of amper, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package amper
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	getcodec "github.com/unkaktus/amper/codec/get"
+)
+
+const (
+	// DefaultFragmentTimeout is the default time to wait
+	// for all fragments of a message.
+	DefaultFragmentTimeout = 30 * time.Second
+	// DefaultMaxFragmentBytes is the default limit of the total
+	// size of fragments pending reassembly.
+	DefaultMaxFragmentBytes = 16 << 20
+)
+
+type partialMessage struct {
+	fragments [][]byte
+	received  int
+	size      int
+	expires   time.Time
+}
+
+// reassembler collects fragments until messages are complete.
+type reassembler struct {
+	mu       sync.Mutex
+	messages map[uint64]*partialMessage
+	// delivered holds the expiry times of the IDs of complete
+	// messages, so that resent fragments are not taken
+	// for new messages.
+	delivered map[uint64]time.Time
+	// size is the total size of pending fragments.
+	size int
+}
+
+// expire drops the messages which were not completed in time,
+// and forgets the delivered ones after the same time.
+func (ra *reassembler) expire(now time.Time) {
+	for id, m := range ra.messages {
+		if now.After(m.expires) {
+			ra.size -= m.size
+			delete(ra.messages, id)
+		}
+	}
+	for id, expires := range ra.delivered {
+		if now.After(expires) {
+			delete(ra.delivered, id)
+		}
+	}
+}
+
+// add adds data of fragment f and returns the whole message
+// once all its fragments are received.
+func (ra *reassembler) add(f *getcodec.Fragment, data []byte, timeout time.Duration, maxBytes int) ([]byte, bool, error) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	now := time.Now()
+	if ra.messages == nil {
+		ra.messages = make(map[uint64]*partialMessage)
+		ra.delivered = make(map[uint64]time.Time)
+	}
+	ra.expire(now)
+
+	if _, ok := ra.delivered[f.ID]; ok {
+		return nil, false, ErrFragmentDelivered
+	}
+	m, ok := ra.messages[f.ID]
+	if !ok {
+		m = &partialMessage{
+			fragments: make([][]byte, f.Count),
+			expires:   now.Add(timeout),
+		}
+		ra.messages[f.ID] = m
+	}
+	if len(m.fragments) != f.Count {
+		return nil, false, ErrFragmentMismatch
+	}
+	if m.fragments[f.Index] != nil {
+		// Duplicate fragment
+		return nil, false, nil
+	}
+	if ra.size+len(data) > maxBytes {
+		if m.received == 0 {
+			delete(ra.messages, f.ID)
+		}
+		return nil, false, ErrFragmentBufferFull
+	}
+	m.fragments[f.Index] = append([]byte{}, data...)
+	m.received++
+	m.size += len(data)
+	ra.size += len(data)
+	if m.received != f.Count {
+		return nil, false, nil
+	}
+	ra.size -= m.size
+	delete(ra.messages, f.ID)
+	ra.delivered[f.ID] = now.Add(timeout)
+	return bytes.Join(m.fragments, nil), true, nil
+}
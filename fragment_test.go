@@ -0,0 +1,43 @@
+package amper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	getcodec "github.com/unkaktus/amper/codec/get"
+)
+
+func TestReassembler(t *testing.T) {
+	is := is.New(t)
+	ra := &reassembler{}
+	f := func(id uint64, index, count int) *getcodec.Fragment {
+		return &getcodec.Fragment{ID: id, Index: index, Count: count}
+	}
+
+	_, ok, err := ra.add(f(1, 1, 2), []byte("lo"), time.Minute, 10)
+	is.NoErr(err)
+	is.True(!ok)
+	_, _, err = ra.add(f(1, 0, 3), []byte("hel"), time.Minute, 10)
+	is.Equal(err, ErrFragmentMismatch)
+	_, _, err = ra.add(f(2, 0, 2), make([]byte, 9), time.Minute, 10)
+	is.Equal(err, ErrFragmentBufferFull)
+	msg, ok, err := ra.add(f(1, 0, 2), []byte("hel"), time.Minute, 10)
+	is.NoErr(err)
+	is.True(ok)
+	is.Equal(string(msg), "hello")
+	is.Equal(ra.size, 0)
+	// Resent fragments of delivered messages are recognized.
+	_, _, err = ra.add(f(1, 1, 2), []byte("lo"), time.Minute, 10)
+	is.Equal(err, ErrFragmentDelivered)
+	is.Equal(ra.size, 0)
+
+	// Incomplete messages expire.
+	_, _, err = ra.add(f(3, 0, 2), []byte("abc"), 0, 10)
+	is.NoErr(err)
+	time.Sleep(time.Millisecond)
+	_, ok, err = ra.add(f(3, 1, 2), []byte("d"), 0, 10)
+	is.NoErr(err)
+	is.True(!ok)
+	is.Equal(ra.size, 1)
+}
@@ -0,0 +1,204 @@
+// frontpool.go - pool of fronting domains.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of amper, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package amper
+
+import (
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMinFrontBackoff is the default time a front is
+	// avoided for after its first failure.
+	DefaultMinFrontBackoff = 5 * time.Second
+	// DefaultMaxFrontBackoff is the default maximum time
+	// a failing front is avoided for.
+	DefaultMaxFrontBackoff = 10 * time.Minute
+	// frontStatsDecay is the weight of the newest sample in
+	// the moving averages of front stats.
+	frontStatsDecay = 0.2
+	// minFrontScore keeps failing fronts pickable in weighted pools.
+	minFrontScore = 0.01
+)
+
+// FrontStats describes the health of a front.
+type FrontStats struct {
+	// Front is the fronting domain.
+	Front string
+	// Weight is the weight of the front in weighted pools.
+	Weight float64
+	// SuccessRate is the moving average of the success rate.
+	SuccessRate float64
+	// Latency is the moving average of round trip latency.
+	Latency time.Duration
+	// Failures is the number of consecutive failures.
+	Failures int
+	// RetryAt is the time until which the front is avoided.
+	RetryAt time.Time
+}
+
+// FrontPool is a pool of fronting domains which tracks their
+// health and fails over from the fronts that stop working.
+// A failing front is avoided for an exponentially growing time,
+// after which it is tried again.
+// FrontPool is safe for concurrent use.
+type FrontPool struct {
+	// Weighted makes the pool pick fronts at random in proportion
+	// to their weights and success rates. Otherwise the first
+	// working front is picked.
+	Weighted bool
+	// MinBackoff is the time a front is avoided for after its
+	// first failure. Defaults to DefaultMinFrontBackoff if not set.
+	MinBackoff time.Duration
+	// MaxBackoff is the maximum time a failing front is avoided for.
+	// Defaults to DefaultMaxFrontBackoff if not set.
+	MaxBackoff time.Duration
+
+	mu     sync.Mutex
+	fronts []*FrontStats
+}
+
+// NewFrontPool creates a FrontPool with fronts in the order of preference.
+func NewFrontPool(fronts ...string) *FrontPool {
+	p := &FrontPool{}
+	for _, front := range fronts {
+		p.Add(front, 1)
+	}
+	return p
+}
+
+// Add adds front with weight to the pool.
+func (p *FrontPool) Add(front string, weight float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fronts = append(p.fronts, &FrontStats{
+		Front:       front,
+		Weight:      weight,
+		SuccessRate: 1,
+	})
+}
+
+// Pick returns the front to use for the next request.
+// If all fronts are avoided, the one to be retried
+// the soonest is returned.
+func (p *FrontPool) Pick() string {
+	return p.PickExcept()
+}
+
+// PickExcept is like Pick but avoids the fronts in exclude
+// unless there are no other fronts in the pool.
+func (p *FrontPool) PickExcept(exclude ...string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fronts := p.fronts
+	if len(exclude) != 0 {
+		fronts = nil
+		for _, f := range p.fronts {
+			if !slices.Contains(exclude, f.Front) {
+				fronts = append(fronts, f)
+			}
+		}
+		if len(fronts) == 0 {
+			fronts = p.fronts
+		}
+	}
+	if len(fronts) == 0 {
+		return ""
+	}
+	now := time.Now()
+	var available []*FrontStats
+	for _, f := range fronts {
+		if !now.Before(f.RetryAt) {
+			available = append(available, f)
+		}
+	}
+	if len(available) == 0 {
+		soonest := fronts[0]
+		for _, f := range fronts[1:] {
+			if f.RetryAt.Before(soonest.RetryAt) {
+				soonest = f
+			}
+		}
+		return soonest.Front
+	}
+	if !p.Weighted {
+		return available[0].Front
+	}
+	total := 0.0
+	for _, f := range available {
+		total += f.score()
+	}
+	x := rand.Float64() * total
+	for _, f := range available {
+		x -= f.score()
+		if x < 0 {
+			return f.Front
+		}
+	}
+	return available[len(available)-1].Front
+}
+
+func (f *FrontStats) score() float64 {
+	return f.Weight * max(f.SuccessRate, minFrontScore)
+}
+
+// Report records the outcome of a request made through front.
+// A nil err means success.
+func (p *FrontPool) Report(front string, latency time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, f := range p.fronts {
+		if f.Front != front {
+			continue
+		}
+		if err == nil {
+			f.SuccessRate += frontStatsDecay * (1 - f.SuccessRate)
+			if f.Latency == 0 {
+				f.Latency = latency
+			} else {
+				f.Latency += time.Duration(frontStatsDecay * float64(latency-f.Latency))
+			}
+			f.Failures = 0
+			f.RetryAt = time.Time{}
+			continue
+		}
+		f.SuccessRate -= frontStatsDecay * f.SuccessRate
+		f.Failures++
+		f.RetryAt = time.Now().Add(p.backoff(f.Failures))
+	}
+}
+
+// backoff returns the time to avoid a front after n consecutive failures.
+func (p *FrontPool) backoff(n int) time.Duration {
+	minBackoff := DefaultMinFrontBackoff
+	if p.MinBackoff != 0 {
+		minBackoff = p.MinBackoff
+	}
+	maxBackoff := DefaultMaxFrontBackoff
+	if p.MaxBackoff != 0 {
+		maxBackoff = p.MaxBackoff
+	}
+	backoff := minBackoff
+	for i := 1; i < n && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxBackoff)
+}
+
+// Stats returns the current stats of all fronts in the pool.
+func (p *FrontPool) Stats() []FrontStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := make([]FrontStats, len(p.fronts))
+	for i, f := range p.fronts {
+		stats[i] = *f
+	}
+	return stats
+}
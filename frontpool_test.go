@@ -0,0 +1,87 @@
+package amper
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestFrontPoolFailover(t *testing.T) {
+	is := is.New(t)
+	p := NewFrontPool("a.example", "b.example")
+	p.MinBackoff = 20 * time.Millisecond
+	p.MaxBackoff = time.Second
+
+	is.Equal(p.Pick(), "a.example")
+	p.Report("a.example", time.Millisecond, errors.New("blocked"))
+	is.Equal(p.Pick(), "b.example")
+	p.Report("b.example", time.Millisecond, nil)
+	is.Equal(p.Pick(), "b.example")
+
+	// The preferred front is retried after the backoff.
+	time.Sleep(30 * time.Millisecond)
+	is.Equal(p.Pick(), "a.example")
+	p.Report("a.example", time.Millisecond, errors.New("blocked"))
+	stats := p.Stats()
+	is.Equal(stats[0].Failures, 2)
+	is.True(time.Until(stats[0].RetryAt) > 20*time.Millisecond)
+
+	// With all fronts failing, the soonest to retry is picked.
+	p.Report("b.example", time.Millisecond, errors.New("blocked"))
+	is.Equal(p.Pick(), "b.example")
+}
+
+func TestFrontPoolBackoff(t *testing.T) {
+	is := is.New(t)
+	p := &FrontPool{MinBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	is.Equal(p.backoff(1), time.Second)
+	is.Equal(p.backoff(3), 4*time.Second)
+	is.Equal(p.backoff(10), 5*time.Second)
+}
+
+func TestFrontPoolWeighted(t *testing.T) {
+	is := is.New(t)
+	p := &FrontPool{Weighted: true}
+	p.Add("a.example", 1)
+	p.Add("b.example", 0)
+	for i := 0; i < 10; i++ {
+		is.Equal(p.Pick(), "a.example")
+	}
+}
+
+func TestFrontPoolPickExcept(t *testing.T) {
+	is := is.New(t)
+	p := NewFrontPool("a.example", "b.example")
+	is.Equal(p.PickExcept("a.example"), "b.example")
+	is.Equal(p.PickExcept("a.example", "b.example"), "a.example")
+}
+
+func TestFrontPoolServerError(t *testing.T) {
+	is := is.New(t)
+	server := &Server{Handler: HandlerFunc(func(w io.Writer, r io.Reader) error {
+		return errors.New("failed")
+	})}
+	c := &Client{
+		Host:      "amp.example.org",
+		FrontPool: NewFrontPool("a.example", "b.example"),
+		Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, r)
+			return w.Result(), nil
+		}),
+	}
+	_, err := c.RoundTrip(bytes.NewReader([]byte("x")))
+	var serr *ServerError
+	is.True(errors.As(err, &serr))
+	// Errors of the server do not count against the front.
+	stats := c.FrontPool.Stats()
+	is.Equal(stats[0].Failures, 0)
+	is.True(stats[0].SuccessRate > 0)
+	is.Equal(c.FrontPool.Pick(), "a.example")
+}
@@ -10,6 +10,7 @@ require (
 	github.com/unkaktus/cabin v0.3.1
 	github.com/unkaktus/frontier v0.5.0
 	golang.org/x/net v0.28.0
+	golang.org/x/text v0.17.0
 )
 
 require (
@@ -0,0 +1,208 @@
+// hedge.go - hedged requests.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of amper, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package amper
+
+import (
+	"context"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHedgePercentile is the default latency percentile
+	// after which a hedged request is sent.
+	DefaultHedgePercentile = 0.95
+	// DefaultHedgeDelay is the default delay before a hedged request
+	// until enough latency samples are collected.
+	DefaultHedgeDelay = 2 * time.Second
+	// hedgeSamples is the number of latest latency samples kept.
+	hedgeSamples = 128
+	// minHedgeSamples is the number of latency samples required
+	// to compute the percentile.
+	minHedgeSamples = 10
+)
+
+// HedgePolicy describes how Client hedges slow requests.
+// A hedged request carries the same payload with the same
+// random slug as the original one, and it is sent via the next
+// CDN profile of CDNProfiles and another front serving it.
+// The first decoded reply is used and the other requests are
+// canceled. Server replays the reply to requests with
+// the same slug, so the Handler runs only once.
+// HedgePolicy is safe for concurrent use.
+type HedgePolicy struct {
+	// MaxHedges is the maximum number of hedged requests
+	// per request. Defaults to 1 if not set.
+	MaxHedges int
+	// Percentile is the percentile of observed latencies after which
+	// a hedged request is sent. Defaults to DefaultHedgePercentile if not set.
+	Percentile float64
+	// InitialDelay is the delay before a hedged request until
+	// there are enough latency samples.
+	// Defaults to DefaultHedgeDelay if not set.
+	InitialDelay time.Duration
+	// MinDelay and MaxDelay bound the delay before a hedged request.
+	MinDelay time.Duration
+	MaxDelay time.Duration
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	next      int
+}
+
+func (p *HedgePolicy) maxHedges() int {
+	if p.MaxHedges != 0 {
+		return p.MaxHedges
+	}
+	return 1
+}
+
+// observe records the latency of a successful request.
+func (p *HedgePolicy) observe(latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.latencies) < hedgeSamples {
+		p.latencies = append(p.latencies, latency)
+		return
+	}
+	p.latencies[p.next] = latency
+	p.next = (p.next + 1) % hedgeSamples
+}
+
+// delay returns the delay before sending a hedged request.
+func (p *HedgePolicy) delay() time.Duration {
+	p.mu.Lock()
+	latencies := slices.Clone(p.latencies)
+	p.mu.Unlock()
+
+	delay := DefaultHedgeDelay
+	if p.InitialDelay != 0 {
+		delay = p.InitialDelay
+	}
+	if len(latencies) >= minHedgeSamples {
+		percentile := DefaultHedgePercentile
+		if p.Percentile != 0 {
+			percentile = p.Percentile
+		}
+		slices.Sort(latencies)
+		i := int(percentile * float64(len(latencies)-1))
+		delay = latencies[i]
+	}
+	delay = max(delay, p.MinDelay)
+	if p.MaxDelay != 0 {
+		delay = min(delay, p.MaxDelay)
+	}
+	return delay
+}
+
+type hedgeResult struct {
+	data io.ReadCloser
+	err  error
+	// index is the index of the request in launch order.
+	index int
+}
+
+// hedgedBody is the reply of the winning request. Closing it
+// cancels the context the reply is streamed within.
+type hedgedBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *hedgedBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// roundTripHedged requests reqPath from the server, sending hedged
+// requests according to HedgePolicy.
+func (c *Client) roundTripHedged(ctx context.Context, reqPath string) (io.ReadCloser, error) {
+	p := c.HedgePolicy
+	start := time.Now()
+	results := make(chan hedgeResult, p.maxHedges()+1)
+	var fronts []string
+	// Each request has its own context, so that the losers
+	// are canceled while the winner streams its reply.
+	var cancels []context.CancelFunc
+	launch := func() {
+		rctx, cancel := context.WithCancel(ctx)
+		cancels = append(cancels, cancel)
+		index := len(cancels) - 1
+		r, err := c.pickRoute(fronts...)
+		if err != nil {
+			fronts = append(fronts, "")
+			results <- hedgeResult{err: err, index: index}
+			return
+		}
+		fronts = append(fronts, r.front)
+		go func() {
+			data, err := c.roundTripVia(rctx, reqPath, r)
+			results <- hedgeResult{data: data, err: err, index: index}
+		}()
+	}
+	// cancelExcept cancels all requests but the winner, and closes
+	// the replies of the requests in flight once they arrive.
+	cancelExcept := func(winner, inflight int) {
+		for i, cancel := range cancels {
+			if i != winner {
+				cancel()
+			}
+		}
+		if inflight == 0 {
+			return
+		}
+		go func() {
+			for ; inflight > 0; inflight-- {
+				if r := <-results; r.err == nil {
+					r.data.Close()
+				}
+			}
+		}()
+	}
+
+	launch()
+	inflight := 1
+	timer := time.NewTimer(p.delay())
+	defer timer.Stop()
+	var firstErr error
+	for {
+		select {
+		case r := <-results:
+			inflight--
+			if r.err == nil {
+				p.observe(time.Since(start))
+				cancelExcept(r.index, inflight)
+				return &hedgedBody{ReadCloser: r.data, cancel: cancels[r.index]}, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if inflight != 0 {
+				continue
+			}
+			if len(fronts) > p.maxHedges() {
+				cancelExcept(-1, 0)
+				return nil, firstErr
+			}
+			// Everything failed, so do not wait to hedge.
+			launch()
+			inflight++
+		case <-timer.C:
+			if len(fronts) <= p.maxHedges() {
+				launch()
+				inflight++
+				timer.Reset(p.delay())
+			}
+		case <-ctx.Done():
+			cancelExcept(-1, inflight)
+			return nil, contextError(ctx, ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package amper
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	getcodec "github.com/unkaktus/amper/codec/get"
+)
+
+func TestHedgedRoundTrip(t *testing.T) {
+	is := is.New(t)
+	server := &Server{Handler: echoHandler()}
+	var mu sync.Mutex
+	var fronts []string
+	c := &Client{
+		Host:      "amp.example.org",
+		FrontPool: NewFrontPool("slow.example", "fast.example"),
+		Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+			mu.Lock()
+			fronts = append(fronts, r.URL.Host)
+			mu.Unlock()
+			if r.URL.Host == "slow.example" {
+				<-r.Context().Done()
+				return nil, r.Context().Err()
+			}
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, r)
+			return w.Result(), nil
+		}),
+		HedgePolicy: &HedgePolicy{InitialDelay: 10 * time.Millisecond},
+	}
+	resp, err := c.RoundTrip(bytes.NewReader([]byte("x")))
+	is.NoErr(err)
+	b, err := io.ReadAll(resp)
+	is.NoErr(err)
+	is.Equal(string(b), "x")
+	mu.Lock()
+	is.Equal(fronts, []string{"slow.example", "fast.example"})
+	mu.Unlock()
+	// The canceled request is not held against the slow front.
+	is.Equal(c.FrontPool.Stats()[0].Failures, 0)
+}
+
+func TestHedgeDelay(t *testing.T) {
+	is := is.New(t)
+	p := &HedgePolicy{Percentile: 0.5, MaxDelay: 8 * time.Millisecond}
+	is.Equal(p.delay(), 8*time.Millisecond)
+	p.MaxDelay = 0
+	is.Equal(p.delay(), DefaultHedgeDelay)
+	for i := 1; i <= 11; i++ {
+		p.observe(time.Duration(i) * time.Millisecond)
+	}
+	is.Equal(p.delay(), 6*time.Millisecond)
+}
+
+func TestServerCoalescesDuplicates(t *testing.T) {
+	is := is.New(t)
+	var calls int32
+	server := &Server{Handler: HandlerFunc(func(w io.Writer, r io.Reader) error {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(50 * time.Millisecond)
+		_, err := io.Copy(w, r)
+		return err
+	})}
+	reqPath, err := getcodec.Encode(bytes.NewReader([]byte("x")))
+	is.NoErr(err)
+
+	var wg sync.WaitGroup
+	pages := make([][]byte, 3)
+	for i := range pages {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+reqPath, nil))
+			pages[i] = w.Body.Bytes()
+		}(i)
+	}
+	wg.Wait()
+	is.Equal(atomic.LoadInt32(&calls), int32(1))
+	is.Equal(pages[0], pages[1])
+	is.Equal(pages[1], pages[2])
+}
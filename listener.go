@@ -0,0 +1,234 @@
+// listener.go - server side of amper stream sessions.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of amper, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package amper
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSessionTimeout is the default time after which
+	// idle sessions are dropped.
+	DefaultSessionTimeout = 2 * time.Minute
+	// sessionMaxDownstream is the maximum size of data in
+	// a single downstream segment.
+	sessionMaxDownstream = 32 * 1024
+	// maxRequestSize limits the size of a request segment.
+	maxRequestSize = 64 * 1024
+	// acceptBacklog is the number of sessions waiting for Accept.
+	acceptBacklog = 64
+	// sessionLinger is the time sessions closed on both ends are kept
+	// for, so that the peer retransmitting its end of stream gets
+	// ours again, as the reply carrying it may have been lost.
+	sessionLinger = 30 * time.Second
+)
+
+// listenerAddr is the local address of all server sessions.
+var listenerAddr = Addr("amper")
+
+type serverSession struct {
+	*stream
+	lastSeen time.Time
+	// closedAt is the time the session got closed on both ends.
+	closedAt time.Time
+}
+
+// Listener is a net.Listener of stream sessions established with Dial.
+// Listener is a Handler, and it receives sessions by serving as
+// the Handler of a Server.
+type Listener struct {
+	// SessionTimeout is the time after which idle sessions are
+	// dropped. If zero, DefaultSessionTimeout is used.
+	SessionTimeout time.Duration
+	// PollTimeout is the time a request waits for downstream data
+	// to become available before being replied to.
+	// If zero, requests are replied to immediately.
+	PollTimeout time.Duration
+
+	mu        sync.Mutex
+	sessions  map[sessionID]*serverSession
+	accept    chan *serverSession
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewListener creates a Listener.
+func NewListener() *Listener {
+	ln := &Listener{
+		sessions: make(map[sessionID]*serverSession),
+		accept:   make(chan *serverSession, acceptBacklog),
+		done:     make(chan struct{}),
+	}
+	go ln.expire()
+	return ln
+}
+
+// Accept waits for and returns the next session.
+func (ln *Listener) Accept() (net.Conn, error) {
+	select {
+	case s := <-ln.accept:
+		return s, nil
+	case <-ln.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the Listener and resets all its sessions.
+func (ln *Listener) Close() error {
+	err := net.ErrClosed
+	ln.closeOnce.Do(func() {
+		close(ln.done)
+		ln.mu.Lock()
+		for id, s := range ln.sessions {
+			s.fail(ErrSessionReset)
+			delete(ln.sessions, id)
+		}
+		ln.mu.Unlock()
+		err = nil
+	})
+	return err
+}
+
+// Addr returns the Listener address.
+func (ln *Listener) Addr() net.Addr {
+	return listenerAddr
+}
+
+func (ln *Listener) sessionTimeout() time.Duration {
+	if ln.SessionTimeout != 0 {
+		return ln.SessionTimeout
+	}
+	return DefaultSessionTimeout
+}
+
+// expire drops idle sessions and the closed ones
+// which have lingered enough.
+func (ln *Listener) expire() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ln.done:
+			return
+		}
+		timeout := ln.sessionTimeout()
+		ln.mu.Lock()
+		for id, s := range ln.sessions {
+			switch {
+			case !s.closedAt.IsZero():
+				if time.Since(s.closedAt) > sessionLinger {
+					delete(ln.sessions, id)
+				}
+			case time.Since(s.lastSeen) > timeout:
+				s.fail(ErrSessionTimeout)
+				delete(ln.sessions, id)
+			}
+		}
+		ln.mu.Unlock()
+	}
+}
+
+// session returns the session seg belongs to, creating it if
+// seg opens a new one. It returns nil if there is no such session.
+func (ln *Listener) session(seg *segment) *serverSession {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if isClosedChan(ln.done) {
+		return nil
+	}
+	s, ok := ln.sessions[seg.id]
+	if ok {
+		s.lastSeen = time.Now()
+		return s
+	}
+	if seg.flags&flagSYN == 0 || seg.seq != 0 {
+		return nil
+	}
+	s = &serverSession{
+		stream:   newStream(listenerAddr, Addr(seg.id.String())),
+		lastSeen: time.Now(),
+	}
+	select {
+	case ln.accept <- s:
+	default:
+		return nil
+	}
+	ln.sessions[seg.id] = s
+	return s
+}
+
+// closed removes session s closed on both ends once the peer
+// has acknowledged our end of stream, and otherwise keeps it
+// lingering for retransmits.
+func (ln *Listener) closed(id sessionID, s *serverSession) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if s.finished() {
+		delete(ln.sessions, id)
+		return
+	}
+	if s.closedAt.IsZero() {
+		s.closedAt = time.Now()
+	}
+}
+
+// Handle handles a single round trip of a session.
+func (ln *Listener) Handle(w io.Writer, r io.Reader) error {
+	return ln.HandleContext(context.Background(), nil, w, r)
+}
+
+// HandleContext handles a single round trip of a session.
+// Waiting for downstream data stops when ctx is canceled.
+func (ln *Listener) HandleContext(ctx context.Context, info *RequestInfo, w io.Writer, r io.Reader) error {
+	b, err := io.ReadAll(io.LimitReader(r, maxRequestSize))
+	if err != nil {
+		return err
+	}
+	seg, err := parseRequest(b)
+	if err != nil {
+		return err
+	}
+	s := ln.session(seg)
+	if s == nil {
+		_, err = w.Write((&segment{flags: flagRST}).marshalResponse())
+		return err
+	}
+	s.acknowledge(seg.ack)
+	s.deliver(seg.seq, seg.data, seg.flags&flagFIN != 0)
+
+	if ln.PollTimeout != 0 && !s.hasOutgoing() {
+		timer := time.NewTimer(ln.PollTimeout)
+		select {
+		case <-s.pending:
+		case <-s.done:
+		case <-ctx.Done():
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+
+	seq, data, fin := s.outgoing(sessionMaxDownstream)
+	resp := &segment{
+		seq:  seq,
+		ack:  s.ackNumber(),
+		data: data,
+	}
+	if fin {
+		resp.flags |= flagFIN
+	}
+	if s.closedBoth() {
+		ln.closed(seg.id, s)
+	}
+	_, err = w.Write(resp.marshalResponse())
+	return err
+}
@@ -0,0 +1,461 @@
+// packetconn.go - datagram transport over amper round trips.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of amper, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package amper
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Packet conns are unreliable, in the manner of Snowflake's turbotunnel:
+// packets are queued and batched into round trips, and are dropped when
+// a queue is full or a round trip fails. Reliability is left to the
+// protocol on top, e.g. KCP or QUIC.
+//
+// An upstream payload is the client ID followed by packets, and
+// a downstream payload consists of packets only. Each packet is prefixed
+// by its length as a big-endian uint16.
+
+const (
+	// MaxPacketSize is the maximum size of a packet.
+	MaxPacketSize = 0xffff
+	// packetQueueSize is the number of packets a queue holds.
+	packetQueueSize = 128
+	// packetMaxUpstream and packetMaxDownstream limit the amount
+	// of packet data in a single round trip.
+	packetMaxUpstream   = 1500
+	packetMaxDownstream = 32 * 1024
+)
+
+var (
+	// ErrPacketTooLarge designates that the packet is larger
+	// than MaxPacketSize.
+	ErrPacketTooLarge = errors.New("packet is too large")
+
+	errMalformedPacket = errors.New("malformed packet")
+)
+
+func appendPacket(b, p []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(p)))
+	return append(b, p...)
+}
+
+func parsePackets(b []byte) ([][]byte, error) {
+	var packets [][]byte
+	for len(b) != 0 {
+		if len(b) < 2 {
+			return packets, errMalformedPacket
+		}
+		n := int(binary.BigEndian.Uint16(b))
+		b = b[2:]
+		if len(b) < n {
+			return packets, errMalformedPacket
+		}
+		packets = append(packets, b[:n:n])
+		b = b[n:]
+	}
+	return packets, nil
+}
+
+// queuePacket puts p into q, dropping it if q is full.
+func queuePacket(q chan []byte, p []byte) {
+	select {
+	case q <- p:
+	default:
+	}
+}
+
+// ClientPacketConn is a net.PacketConn that exchanges packets with
+// a ServerPacketConn behind the server of a Client.
+// The address argument of WriteTo is ignored.
+type ClientPacketConn struct {
+	client *Client
+	id     sessionID
+	recv   chan []byte
+	send   chan []byte
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+// NewClientPacketConn creates a ClientPacketConn that carries
+// packets over round trips of c. It polls the server in background
+// until it is closed.
+func NewClientPacketConn(c *Client) *ClientPacketConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	pc := &ClientPacketConn{
+		client:        c,
+		id:            newSessionID(),
+		recv:          make(chan []byte, packetQueueSize),
+		send:          make(chan []byte, packetQueueSize),
+		ctx:           ctx,
+		cancel:        cancel,
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+	}
+	go pc.poll()
+	return pc
+}
+
+// ReadFrom reads a packet from the server.
+func (pc *ClientPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	if isClosedChan(pc.readDeadline.wait()) {
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+	select {
+	case packet := <-pc.recv:
+		return copy(p, packet), pc.RemoteAddr(), nil
+	case <-pc.ctx.Done():
+		return 0, nil, net.ErrClosed
+	case <-pc.readDeadline.wait():
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+// WriteTo queues packet p to be sent to the server.
+func (pc *ClientPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if isClosedChan(pc.writeDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if pc.ctx.Err() != nil {
+		return 0, net.ErrClosed
+	}
+	if len(p) > MaxPacketSize {
+		return 0, ErrPacketTooLarge
+	}
+	queuePacket(pc.send, append(make([]byte, 0, len(p)), p...))
+	return len(p), nil
+}
+
+// Close stops the ClientPacketConn. Queued packets are dropped.
+func (pc *ClientPacketConn) Close() error {
+	err := net.ErrClosed
+	pc.closeOnce.Do(func() {
+		pc.cancel()
+		err = nil
+	})
+	return err
+}
+
+// LocalAddr returns the client ID as an Addr.
+func (pc *ClientPacketConn) LocalAddr() net.Addr {
+	return Addr(pc.id.String())
+}
+
+// RemoteAddr returns the server host as an Addr.
+func (pc *ClientPacketConn) RemoteAddr() net.Addr {
+	return Addr(pc.client.Host)
+}
+
+func (pc *ClientPacketConn) SetDeadline(t time.Time) error {
+	pc.readDeadline.set(t)
+	pc.writeDeadline.set(t)
+	return nil
+}
+
+func (pc *ClientPacketConn) SetReadDeadline(t time.Time) error {
+	pc.readDeadline.set(t)
+	return nil
+}
+
+func (pc *ClientPacketConn) SetWriteDeadline(t time.Time) error {
+	pc.writeDeadline.set(t)
+	return nil
+}
+
+func (pc *ClientPacketConn) roundTrip(payload []byte) ([][]byte, error) {
+	ctx, cancel := context.WithTimeout(pc.ctx, sessionRequestTimeout)
+	defer cancel()
+	resp, err := pc.client.RoundTripContext(ctx, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+	b, err := io.ReadAll(resp)
+	if err != nil {
+		return nil, err
+	}
+	return parsePackets(b)
+}
+
+// poll batches queued packets into round trips and
+// polls the server for downstream packets.
+func (pc *ClientPacketConn) poll() {
+	interval := sessionMinPollInterval
+	// stash is a packet taken from the queue but not sent yet.
+	// Packets may be empty, so stashed tells whether there is one.
+	var stash []byte
+	stashed := false
+	for {
+		payload := append([]byte(nil), pc.id[:]...)
+		if stashed {
+			payload = appendPacket(payload, stash)
+			stash, stashed = nil, false
+		}
+	batch:
+		for {
+			select {
+			case p := <-pc.send:
+				if len(payload) > len(pc.id) && len(payload)+2+len(p) > packetMaxUpstream {
+					stash, stashed = p, true
+					break batch
+				}
+				payload = appendPacket(payload, p)
+			default:
+				break batch
+			}
+		}
+		sent := len(payload) > len(pc.id)
+
+		packets, err := pc.roundTrip(payload)
+		if pc.ctx.Err() != nil {
+			return
+		}
+		for _, p := range packets {
+			queuePacket(pc.recv, p)
+		}
+
+		if err == nil && (sent || len(packets) != 0) {
+			interval = sessionMinPollInterval
+		} else {
+			interval = min(2*interval, sessionMaxPollInterval)
+		}
+		if stashed || len(pc.send) != 0 {
+			continue
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case p := <-pc.send:
+			stash, stashed = p, true
+		case <-timer.C:
+		case <-pc.ctx.Done():
+		}
+		timer.Stop()
+		if pc.ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+type packetFrom struct {
+	data []byte
+	addr net.Addr
+}
+
+type packetClient struct {
+	send     chan []byte
+	lastSeen time.Time
+}
+
+// ServerPacketConn is a net.PacketConn that exchanges packets with
+// ClientPacketConns. ServerPacketConn is a Handler, and it receives
+// packets by serving as the Handler of a Server. Clients are
+// addressed by Addr of their client IDs.
+type ServerPacketConn struct {
+	// ClientTimeout is the time after which queues of idle clients
+	// are dropped. If zero, DefaultSessionTimeout is used.
+	ClientTimeout time.Duration
+	// PollTimeout is the time a request waits for downstream packets
+	// to become available before being replied to.
+	// If zero, requests are replied to immediately.
+	PollTimeout time.Duration
+
+	mu        sync.Mutex
+	clients   map[Addr]*packetClient
+	recv      chan packetFrom
+	done      chan struct{}
+	closeOnce sync.Once
+
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+// NewServerPacketConn creates a ServerPacketConn.
+func NewServerPacketConn() *ServerPacketConn {
+	pc := &ServerPacketConn{
+		clients:       make(map[Addr]*packetClient),
+		recv:          make(chan packetFrom, packetQueueSize),
+		done:          make(chan struct{}),
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+	}
+	go pc.expire()
+	return pc
+}
+
+// ReadFrom reads a packet from any client.
+func (pc *ServerPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	if isClosedChan(pc.readDeadline.wait()) {
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+	select {
+	case packet := <-pc.recv:
+		return copy(p, packet.data), packet.addr, nil
+	case <-pc.done:
+		return 0, nil, net.ErrClosed
+	case <-pc.readDeadline.wait():
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+// WriteTo queues packet p to be sent to the client at addr
+// in a reply to one of its next requests.
+func (pc *ServerPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if isClosedChan(pc.writeDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if isClosedChan(pc.done) {
+		return 0, net.ErrClosed
+	}
+	if len(p) > MaxPacketSize {
+		return 0, ErrPacketTooLarge
+	}
+	a, ok := addr.(Addr)
+	if !ok {
+		return 0, &net.AddrError{Err: "not an amper address", Addr: addr.String()}
+	}
+	queuePacket(pc.client(a).send, append(make([]byte, 0, len(p)), p...))
+	return len(p), nil
+}
+
+// Close stops the ServerPacketConn. Queued packets are dropped.
+func (pc *ServerPacketConn) Close() error {
+	err := net.ErrClosed
+	pc.closeOnce.Do(func() {
+		close(pc.done)
+		err = nil
+	})
+	return err
+}
+
+// LocalAddr returns the ServerPacketConn address.
+func (pc *ServerPacketConn) LocalAddr() net.Addr {
+	return listenerAddr
+}
+
+func (pc *ServerPacketConn) SetDeadline(t time.Time) error {
+	pc.readDeadline.set(t)
+	pc.writeDeadline.set(t)
+	return nil
+}
+
+func (pc *ServerPacketConn) SetReadDeadline(t time.Time) error {
+	pc.readDeadline.set(t)
+	return nil
+}
+
+func (pc *ServerPacketConn) SetWriteDeadline(t time.Time) error {
+	pc.writeDeadline.set(t)
+	return nil
+}
+
+// client returns the state of the client at addr, creating it if needed.
+func (pc *ServerPacketConn) client(addr Addr) *packetClient {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	c, ok := pc.clients[addr]
+	if !ok {
+		c = &packetClient{send: make(chan []byte, packetQueueSize)}
+		pc.clients[addr] = c
+	}
+	c.lastSeen = time.Now()
+	return c
+}
+
+// expire drops queues of idle clients.
+func (pc *ServerPacketConn) expire() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-pc.done:
+			return
+		}
+		timeout := pc.ClientTimeout
+		if timeout == 0 {
+			timeout = DefaultSessionTimeout
+		}
+		pc.mu.Lock()
+		for addr, c := range pc.clients {
+			if time.Since(c.lastSeen) > timeout {
+				delete(pc.clients, addr)
+			}
+		}
+		pc.mu.Unlock()
+	}
+}
+
+// Handle handles a single round trip of a client.
+func (pc *ServerPacketConn) Handle(w io.Writer, r io.Reader) error {
+	return pc.HandleContext(context.Background(), nil, w, r)
+}
+
+// HandleContext handles a single round trip of a client.
+// Waiting for downstream packets stops when ctx is canceled.
+func (pc *ServerPacketConn) HandleContext(ctx context.Context, info *RequestInfo, w io.Writer, r io.Reader) error {
+	if isClosedChan(pc.done) {
+		return net.ErrClosed
+	}
+	b, err := io.ReadAll(io.LimitReader(r, maxRequestSize))
+	if err != nil {
+		return err
+	}
+	var id sessionID
+	if len(b) < len(id) {
+		return errMalformedPacket
+	}
+	copy(id[:], b)
+	addr := Addr(id.String())
+	packets, err := parsePackets(b[len(id):])
+	for _, p := range packets {
+		select {
+		case pc.recv <- packetFrom{data: p, addr: addr}:
+		default:
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	c := pc.client(addr)
+	var resp []byte
+	if pc.PollTimeout != 0 && len(c.send) == 0 {
+		timer := time.NewTimer(pc.PollTimeout)
+		select {
+		case p := <-c.send:
+			resp = appendPacket(resp, p)
+		case <-pc.done:
+		case <-ctx.Done():
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+collect:
+	for len(resp) < packetMaxDownstream {
+		select {
+		case p := <-c.send:
+			resp = appendPacket(resp, p)
+		default:
+			break collect
+		}
+	}
+	_, err = w.Write(resp)
+	return err
+}
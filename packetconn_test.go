@@ -0,0 +1,88 @@
+package amper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestPacketConn(t *testing.T) {
+	is := is.New(t)
+	server := NewServerPacketConn()
+	defer server.Close()
+	c := newTestClient(t, server)
+
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			server.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	client := NewClientPacketConn(c)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	packets := []string{"one", "two", "three"}
+	for _, p := range packets {
+		_, err := client.WriteTo([]byte(p), nil)
+		is.NoErr(err)
+	}
+	buf := make([]byte, MaxPacketSize)
+	for _, p := range packets {
+		n, _, err := client.ReadFrom(buf)
+		is.NoErr(err)
+		is.Equal(string(buf[:n]), p)
+	}
+}
+
+func TestParsePackets(t *testing.T) {
+	is := is.New(t)
+	var b []byte
+	b = appendPacket(b, []byte("a"))
+	b = appendPacket(b, nil)
+	b = appendPacket(b, []byte("bc"))
+	packets, err := parsePackets(b)
+	is.NoErr(err)
+	is.Equal(len(packets), 3)
+	is.Equal(string(packets[2]), "bc")
+
+	_, err = parsePackets(b[:len(b)-1])
+	is.Equal(err, errMalformedPacket)
+}
+
+func TestPacketConnEmpty(t *testing.T) {
+	is := is.New(t)
+	server := NewServerPacketConn()
+	defer server.Close()
+	c := newTestClient(t, server)
+
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			server.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	client := NewClientPacketConn(c)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, MaxPacketSize)
+	// Empty datagrams are datagrams too, whether they are
+	// sent right away or while the client waits to poll.
+	for _, p := range []string{"", "x", ""} {
+		_, err := client.WriteTo([]byte(p), nil)
+		is.NoErr(err)
+		n, _, err := client.ReadFrom(buf)
+		is.NoErr(err)
+		is.Equal(string(buf[:n]), p)
+	}
+}
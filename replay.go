@@ -0,0 +1,96 @@
+// replay.go - replaying of replies to duplicate requests.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of amper, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package amper
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultReplayTTL is the default time replies are kept
+	// for replaying to duplicate requests.
+	DefaultReplayTTL = 2 * time.Minute
+	// DefaultReplayMaxBytes is the default limit of the total
+	// size of replies kept for replaying.
+	DefaultReplayMaxBytes = 32 << 20
+)
+
+// replyCall is a reply to a request.
+type replyCall struct {
+	done    chan struct{}
+	page    []byte
+	expires time.Time
+}
+
+// replayGroup makes requests with the same slug idempotent.
+// Only the first of them is handled, and the others get
+// a replay of its reply, both while it is being produced
+// and for a while after that.
+type replayGroup struct {
+	mu sync.Mutex
+	// calls holds both pending and cached replies.
+	calls map[string]*replyCall
+	// order holds slugs of cached replies, oldest first.
+	order []string
+	// size is the total size of cached replies.
+	size int
+}
+
+// join returns the call for slug and reports whether
+// the caller is the one to handle the request.
+func (g *replayGroup) join(slug string) (*replyCall, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.calls == nil {
+		g.calls = make(map[string]*replyCall)
+	}
+	now := time.Now()
+	for len(g.order) != 0 && now.After(g.calls[g.order[0]].expires) {
+		g.evict(0)
+	}
+	if call, ok := g.calls[slug]; ok {
+		if call.expires.IsZero() || now.Before(call.expires) {
+			return call, false
+		}
+		// The reply has expired, but is not the oldest one,
+		// as TTL has been changed.
+		g.evict(slices.Index(g.order, slug))
+	}
+	call := &replyCall{done: make(chan struct{})}
+	g.calls[slug] = call
+	return call, true
+}
+
+// finish sets page as the reply of call, releases the waiters
+// and caches the reply for ttl within maxBytes budget.
+func (g *replayGroup) finish(slug string, call *replyCall, page []byte, ttl time.Duration, maxBytes int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	call.page = page
+	close(call.done)
+	if ttl <= 0 || len(page) > maxBytes {
+		delete(g.calls, slug)
+		return
+	}
+	call.expires = time.Now().Add(ttl)
+	g.order = append(g.order, slug)
+	g.size += len(page)
+	for g.size > maxBytes {
+		g.evict(0)
+	}
+}
+
+// evict drops the i-th cached reply.
+func (g *replayGroup) evict(i int) {
+	slug := g.order[i]
+	g.order = slices.Delete(g.order, i, i+1)
+	g.size -= len(g.calls[slug].page)
+	delete(g.calls, slug)
+}
@@ -0,0 +1,132 @@
+package amper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	getcodec "github.com/unkaktus/amper/codec/get"
+)
+
+func TestServerReplay(t *testing.T) {
+	is := is.New(t)
+	calls := 0
+	server := &Server{Handler: HandlerFunc(func(w io.Writer, r io.Reader) error {
+		calls++
+		_, err := io.Copy(w, r)
+		return err
+	})}
+	get := func(reqPath string) []byte {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+reqPath, nil))
+		return w.Body.Bytes()
+	}
+	reqPath, err := getcodec.Encode(bytes.NewReader([]byte("x")))
+	is.NoErr(err)
+
+	page := get(reqPath)
+	is.Equal(get(reqPath), page)
+	is.Equal(calls, 1)
+
+	// A fresh slug is a new request.
+	get(getcodec.Reslug(reqPath))
+	is.Equal(calls, 2)
+
+	// Replies do not outlive the TTL.
+	server.ReplayTTL = time.Millisecond
+	reqPath = getcodec.Reslug(reqPath)
+	get(reqPath)
+	time.Sleep(2 * time.Millisecond)
+	get(reqPath)
+	is.Equal(calls, 4)
+
+	server.ReplayTTL = -1
+	reqPath = getcodec.Reslug(reqPath)
+	get(reqPath)
+	get(reqPath)
+	is.Equal(calls, 6)
+}
+
+func TestReplayGroupBudget(t *testing.T) {
+	is := is.New(t)
+	g := &replayGroup{}
+	for _, slug := range []string{"a", "b", "c"} {
+		call, ok := g.join(slug)
+		is.True(ok)
+		g.finish(slug, call, make([]byte, 4), time.Minute, 10)
+	}
+	is.Equal(g.size, 8)
+	_, ok := g.join("a")
+	is.True(ok) // evicted
+	_, ok = g.join("c")
+	is.True(!ok)
+}
+
+func TestServerReplayLastFragment(t *testing.T) {
+	is := is.New(t)
+	calls := 0
+	server := &Server{Handler: HandlerFunc(func(w io.Writer, r io.Reader) error {
+		calls++
+		_, err := io.Copy(w, r)
+		return err
+	})}
+	get := func(reqPath string) []byte {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+reqPath, nil))
+		return w.Body.Bytes()
+	}
+	reqPaths, err := getcodec.EncodeFragments(bytes.NewReader([]byte("hello, amper")), 5)
+	is.NoErr(err)
+	last := len(reqPaths) - 1
+	for _, reqPath := range reqPaths[:last] {
+		get(reqPath)
+	}
+	page := get(reqPaths[last])
+	is.Equal(calls, 1)
+
+	// The last fragment is resent with a fresh slug, as on retry,
+	// after the reply to the message was lost.
+	is.Equal(get(getcodec.Reslug(reqPaths[last])), page)
+	is.Equal(calls, 1)
+	// So are the other fragments.
+	is.True(bytes.Contains(get(getcodec.Reslug(reqPaths[0])), []byte(">202 <")))
+	is.Equal(calls, 1)
+}
+
+func TestServerReplayFailed(t *testing.T) {
+	is := is.New(t)
+	calls := 0
+	server := &Server{Handler: HandlerFunc(func(w io.Writer, r io.Reader) error {
+		calls++
+		if calls == 1 {
+			return errors.New("fail")
+		}
+		_, err := io.Copy(w, r)
+		return err
+	})}
+	reqPath, err := getcodec.Encode(bytes.NewReader([]byte("x")))
+	is.NoErr(err)
+
+	// Server errors are not replayed.
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+reqPath, nil))
+	}
+	is.Equal(calls, 2)
+
+	// Nor are pages of canceled requests.
+	reqPath = getcodec.Reslug(reqPath)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+reqPath, nil).WithContext(ctx))
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+reqPath, nil))
+	is.Equal(calls, 4)
+}
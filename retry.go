@@ -0,0 +1,103 @@
+// retry.go - retrying of failed round trips.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of amper, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package amper
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	// DefaultMinRetryBackoff is the default delay before the first retry.
+	DefaultMinRetryBackoff = 500 * time.Millisecond
+	// DefaultMaxRetryBackoff is the default maximum delay between retries.
+	DefaultMaxRetryBackoff = 10 * time.Second
+)
+
+// RetryPolicy describes how Client retries failed requests.
+// Every retry is sent with a fresh random slug in the URL,
+// so that a cached failure is not served again.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts,
+	// including the first one.
+	MaxAttempts int
+	// MinBackoff is the delay before the first retry. The delay
+	// doubles with each next retry.
+	// Defaults to DefaultMinRetryBackoff if not set.
+	MinBackoff time.Duration
+	// MaxBackoff is the maximum delay between retries.
+	// Defaults to DefaultMaxRetryBackoff if not set.
+	MaxBackoff time.Duration
+	// Jitter is the fraction of the delay which is randomized,
+	// from 0 (no jitter) to 1.
+	Jitter float64
+	// Retryable reports whether a request that failed
+	// with err is to be retried.
+	// Defaults to DefaultRetryable if not set.
+	Retryable func(err error) bool
+	// OnAttempt, if set, is called after each attempt with its
+	// number starting from 1 and its error, which is nil on success.
+	OnAttempt func(attempt int, err error)
+}
+
+// DefaultRetryable reports whether err is likely to be transient.
+// It retries transport failures, server errors and rate limiting
+// of the CDN, as well as the server being out of room for fragments.
+// Other errors of the server and failures to decode its reply are
+// not retried, since the Handler has run already, and a retry with
+// a fresh slug is not replayed. Cancellation is never retried.
+func DefaultRetryable(err error) bool {
+	var (
+		cerr  *CanceledError
+		serr  *StatusError
+		sverr *ServerError
+		terr  *TransportError
+	)
+	switch {
+	case errors.As(err, &cerr):
+		return false
+	case errors.As(err, &serr):
+		return serr.StatusCode >= 500 || serr.StatusCode == http.StatusTooManyRequests
+	case errors.As(err, &sverr):
+		return sverr.StatusCode == http.StatusServiceUnavailable
+	case errors.As(err, &terr):
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return DefaultRetryable(err)
+}
+
+// backoff returns the delay before the attempt following attempt n.
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	minBackoff := DefaultMinRetryBackoff
+	if p.MinBackoff != 0 {
+		minBackoff = p.MinBackoff
+	}
+	maxBackoff := DefaultMaxRetryBackoff
+	if p.MaxBackoff != 0 {
+		maxBackoff = p.MaxBackoff
+	}
+	delay := minBackoff
+	for i := 1; i < n && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxBackoff)
+	if p.Jitter > 0 {
+		delay -= time.Duration(p.Jitter * rand.Float64() * float64(delay))
+	}
+	return delay
+}
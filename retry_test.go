@@ -0,0 +1,155 @@
+package amper
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	ampcodec "github.com/unkaktus/amper/codec/amp"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	is := is.New(t)
+	server := &Server{Handler: echoHandler()}
+	var slugs []string
+	c := &Client{
+		Host:  "amp.example.org",
+		Front: "www.google.com",
+		Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+			slugs = append(slugs, strings.Split(r.URL.Path, "/")[4])
+			w := httptest.NewRecorder()
+			if len(slugs) < 3 {
+				w.WriteHeader(http.StatusBadGateway)
+			} else {
+				server.ServeHTTP(w, r)
+			}
+			return w.Result(), nil
+		}),
+	}
+	var attempts []error
+	c.RetryPolicy = &RetryPolicy{
+		MaxAttempts: 3,
+		MinBackoff:  time.Millisecond,
+		Jitter:      0.5,
+		OnAttempt: func(attempt int, err error) {
+			is.Equal(attempt, len(attempts)+1)
+			attempts = append(attempts, err)
+		},
+	}
+	resp, err := c.RoundTrip(bytes.NewReader([]byte("x")))
+	is.NoErr(err)
+	b, err := io.ReadAll(resp)
+	is.NoErr(err)
+	is.Equal(string(b), "x")
+	is.Equal(len(attempts), 3)
+	is.True(attempts[0] != nil)
+	is.NoErr(attempts[2])
+	is.True(slugs[0] != slugs[1] && slugs[1] != slugs[2])
+}
+
+func TestRetryPolicyNotRetryable(t *testing.T) {
+	is := is.New(t)
+	requests := 0
+	c := &Client{
+		Host: "amp.example.org",
+		Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+			requests++
+			w := httptest.NewRecorder()
+			w.WriteHeader(http.StatusNotFound)
+			return w.Result(), nil
+		}),
+		RetryPolicy: &RetryPolicy{MaxAttempts: 5, MinBackoff: time.Millisecond},
+	}
+	_, err := c.RoundTrip(bytes.NewReader([]byte("x")))
+	var serr *StatusError
+	is.True(errors.As(err, &serr))
+	is.Equal(requests, 1)
+
+	// The reply may come from the Handler, which is not run again.
+	requests = 0
+	c.Transport = transportFunc(func(r *http.Request) (*http.Response, error) {
+		requests++
+		w := httptest.NewRecorder()
+		io.WriteString(w, "<html><body>not amper</body></html>")
+		return w.Result(), nil
+	})
+	_, err = c.RoundTrip(bytes.NewReader([]byte("x")))
+	var derr *DecodeError
+	is.True(errors.As(err, &derr))
+	is.Equal(requests, 1)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	is := is.New(t)
+	p := &RetryPolicy{MinBackoff: time.Second, MaxBackoff: 3 * time.Second}
+	is.Equal(p.backoff(1), time.Second)
+	is.Equal(p.backoff(2), 2*time.Second)
+	is.Equal(p.backoff(5), 3*time.Second)
+	p.Jitter = 1
+	for i := 0; i < 10; i++ {
+		is.True(p.backoff(1) <= time.Second)
+	}
+}
+
+func TestRetryPolicyHandlerError(t *testing.T) {
+	is := is.New(t)
+	calls := 0
+	c := newTestClient(t, HandlerFunc(func(w io.Writer, r io.Reader) error {
+		calls++
+		return errors.New("failed")
+	}))
+	c.RetryPolicy = &RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond}
+	_, err := c.RoundTrip(bytes.NewReader([]byte("x")))
+	var serr *ServerError
+	is.True(errors.As(err, &serr))
+	is.Equal(serr.StatusCode, http.StatusInternalServerError)
+	is.Equal(calls, 1) // the handler must not run again
+}
+
+func TestRetryPolicyTruncated(t *testing.T) {
+	is := is.New(t)
+	server := &Server{Handler: echoHandler(), Framed: true}
+	requests := 0
+	c := &Client{
+		Host:      "amp.example.org",
+		FrontPool: NewFrontPool("a.example", "b.example"),
+		Framed:    true,
+		Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+			requests++
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, r)
+			if requests == 1 {
+				// The CDN cuts the page short.
+				page := w.Body.String()
+				w.Body.Reset()
+				w.Body.WriteString(page[:strings.Index(page, `<pre id="data">`)+100])
+			}
+			return w.Result(), nil
+		}),
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts: 2,
+			MinBackoff:  time.Millisecond,
+			Retryable: func(err error) bool {
+				return errors.Is(err, ampcodec.ErrTruncated)
+			},
+		},
+	}
+	input := bytes.Repeat([]byte("amper"), 200)
+	resp, err := c.RoundTrip(bytes.NewReader(input))
+	is.NoErr(err)
+	defer resp.Close()
+	output, err := io.ReadAll(resp)
+	is.NoErr(err)
+	is.Equal(output, input)
+	is.Equal(requests, 2)
+	// The truncation is charged to the front.
+	stats := c.FrontPool.Stats()
+	is.Equal(stats[0].Failures, 1)
+	is.Equal(stats[1].Failures, 0)
+}
@@ -8,8 +8,14 @@
 package amper
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	ampcodec "github.com/unkaktus/amper/codec/amp"
 	getcodec "github.com/unkaktus/amper/codec/get"
@@ -19,7 +25,8 @@ import (
 // application-level logic handler.
 type Handler interface {
 	// Handle handles incoming data from r and writes
-	// responses to w.
+	// responses to w. The client gets the message of
+	// the returned error only if it is a *PublicError.
 	Handle(w io.Writer, r io.Reader) error
 }
 
@@ -36,17 +43,182 @@ func HandlerFunc(hf func(w io.Writer, r io.Reader) error) Handler {
 	return handlerFunc{hf: hf}
 }
 
+// RequestInfo describes the HTTP request a payload came in.
+type RequestInfo struct {
+	// Slug is the random string of the request URL.
+	// Duplicate requests share the same slug.
+	Slug string
+	// RemoteAddr is the address of the client, which is
+	// the first address in X-Forwarded-For header if any.
+	// It is usually the address of the CDN fetcher.
+	RemoteAddr string
+	// ForwardedFor is the list of addresses in
+	// X-Forwarded-For header.
+	ForwardedFor []string
+	// CDN is the name of the CDN that fetched the request,
+	// "google" or "bing", guessed from User-Agent.
+	// It is empty if the CDN is unknown.
+	CDN string
+	// Header is the header of the HTTP request.
+	Header http.Header
+}
+
+// newRequestInfo collects RequestInfo from the HTTP request r.
+func newRequestInfo(r *http.Request) *RequestInfo {
+	info := &RequestInfo{
+		Slug:       getcodec.Slug(r.URL.RequestURI()),
+		RemoteAddr: r.RemoteAddr,
+		Header:     r.Header,
+	}
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(h, ",") {
+			info.ForwardedFor = append(info.ForwardedFor, strings.TrimSpace(addr))
+		}
+	}
+	if len(info.ForwardedFor) != 0 {
+		info.RemoteAddr = info.ForwardedFor[0]
+	}
+	ua := r.UserAgent()
+	switch {
+	case strings.Contains(ua, "Google-AMPHTML"):
+		info.CDN = "google"
+	case strings.Contains(ua, "bingbot"), strings.Contains(ua, "BingPreview"):
+		info.CDN = "bing"
+	}
+	return info
+}
+
+// ContextHandler is the interface for request handler which
+// is aware of the request context and metadata.
+type ContextHandler interface {
+	// HandleContext handles incoming data from r and writes
+	// responses to w. ctx is canceled when the CDN drops
+	// the connection to the server.
+	HandleContext(ctx context.Context, info *RequestInfo, w io.Writer, r io.Reader) error
+}
+
+type contextHandlerFunc struct {
+	hf func(ctx context.Context, info *RequestInfo, w io.Writer, r io.Reader) error
+}
+
+func (h contextHandlerFunc) HandleContext(ctx context.Context, info *RequestInfo, w io.Writer, r io.Reader) error {
+	return h.hf(ctx, info, w, r)
+}
+
+// ContextHandlerFunc wraps a handler function hf into ContextHandler.
+func ContextHandlerFunc(hf func(ctx context.Context, info *RequestInfo, w io.Writer, r io.Reader) error) ContextHandler {
+	return contextHandlerFunc{hf: hf}
+}
+
+type handlerAdapter struct {
+	h Handler
+}
+
+func (a handlerAdapter) HandleContext(ctx context.Context, info *RequestInfo, w io.Writer, r io.Reader) error {
+	return a.h.Handle(w, r)
+}
+
+// AdaptHandler turns Handler h into ContextHandler.
+// If h is a ContextHandler already, h itself is returned.
+// Otherwise the context and request info are ignored.
+func AdaptHandler(h Handler) ContextHandler {
+	if ch, ok := h.(ContextHandler); ok {
+		return ch
+	}
+	return handlerAdapter{h: h}
+}
+
 // Server is an http.Handler that handles amper requests over
 // AMP pages.
 type Server struct {
 	// Handler to handle requests
 	Handler Handler
+	// ContextHandler to handle requests. If set,
+	// it is used instead of Handler.
+	ContextHandler ContextHandler
 	// UseOldBoilerplate makes AMP encoder use
 	// deprecated AMP boilerplate. As it's much shorter
 	// than the new one, one may benefit from using it
 	// to save some bandwidth.
-	// Note that it doesn't work on Google AMP cache anymore.
+	//
+	// Deprecated: AMP caches reject pages with the old boilerplate.
 	UseOldAMPBoilerplate bool
+	// FragmentTimeout is the time to wait for all fragments
+	// of a fragmented request.
+	// Defaults to DefaultFragmentTimeout if not set.
+	FragmentTimeout time.Duration
+	// MaxFragmentBytes limits the total size of fragments
+	// pending reassembly.
+	// Defaults to DefaultMaxFragmentBytes if not set.
+	MaxFragmentBytes int
+	// FlushOnWrite makes the server flush the response after every
+	// write of the handler, so that the data is streamed to the client
+	// as soon as it is available. Otherwise handlers may flush the writer
+	// themselves, as it implements interface{ Flush() error }.
+	// Note that proxies in front of the server may need to be set
+	// to not buffer responses, e.g. with flush_interval in Caddy.
+	FlushOnWrite bool
+	// ReplayTTL is the time a reply is kept to be replayed to
+	// duplicate requests, which carry the same random slug.
+	// AMP caches may fetch the same URL several times, and
+	// replaying keeps the Handler from handling it again.
+	// Defaults to DefaultReplayTTL if not set. If negative,
+	// only concurrent duplicates get the replay.
+	ReplayTTL time.Duration
+	// ReplayMaxBytes limits the total size of replies kept
+	// for replaying. Older replies are dropped first.
+	// Defaults to DefaultReplayMaxBytes if not set.
+	ReplayMaxBytes int
+	// Carrier embeds replies into the pages. Clients have to
+	// use the same carrier. If nil, ampcodec.PreCarrier is used.
+	Carrier ampcodec.Carrier
+	// Template provides the templates of the pages, e.g.
+	// ampcodec.RandomTemplates to make every page look different.
+	// If nil, ampcodec.DefaultTemplate is used.
+	Template ampcodec.TemplateSource
+	// Marker marks the elements carrying replies in the pages.
+	// Clients have to use the same marker.
+	// If nil, ampcodec.FixedMarker is used.
+	Marker ampcodec.Marker
+	// Framed makes the server frame replies with their length and
+	// checksum. Clients have to be set to expect framed replies.
+	Framed bool
+	// Padding pads replies to hide their size, e.g. to the buckets
+	// of ampcodec.BucketPadding, trading bandwidth for replies
+	// of different sizes looking alike. It implies Framed.
+	Padding ampcodec.Padding
+	// Encoding is the encoding of replies into text, e.g.
+	// ampcodec.Base85 to save bandwidth. Clients tell the encoding
+	// by its marker in the page. Defaults to ampcodec.Base64.
+	Encoding ampcodec.Encoding
+	// Compress makes replies compressed before encoding where it
+	// helps, unlike compression of whole pages. It implies Framed.
+	Compress bool
+
+	reassembler reassembler
+	replay      replayGroup
+}
+
+// reassemble adds fragment f of a request and returns the whole
+// request once all its fragments are received.
+func (ah *Server) reassemble(f *getcodec.Fragment, r *bytes.Reader) (*bytes.Reader, bool, error) {
+	timeout := DefaultFragmentTimeout
+	if ah.FragmentTimeout != 0 {
+		timeout = ah.FragmentTimeout
+	}
+	maxBytes := DefaultMaxFragmentBytes
+	if ah.MaxFragmentBytes != 0 {
+		maxBytes = ah.MaxFragmentBytes
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, false, err
+	}
+	msg, ok, err := ah.reassembler.add(f, data, timeout, maxBytes)
+	if !ok || err != nil {
+		return nil, false, err
+	}
+	return bytes.NewReader(msg), true, nil
 }
 
 func (ah *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -54,19 +226,176 @@ func (ah *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// will not be used anymore.
 	w.Header().Set("Cache-Control", "private, max-age=0")
 
+	// Requests with the same slug are duplicates, e.g. hedged requests
+	// or fetches repeated by the CDN. Handle only the first of them
+	// and replay its reply to the others.
+	slug := replayKey(r.URL.RequestURI())
+	if slug == "" {
+		ah.serve(w, r)
+		return
+	}
+	call, ok := ah.replay.join(slug)
+	if !ok {
+		select {
+		case <-call.done:
+			w.Write(call.page)
+		case <-r.Context().Done():
+		}
+		return
+	}
+	page := &pageRecorder{w: w}
+	code := http.StatusInternalServerError
+	defer func() {
+		ttl := DefaultReplayTTL
+		if ah.ReplayTTL != 0 {
+			ttl = ah.ReplayTTL
+		}
+		// Partial pages of canceled requests and server errors
+		// are not to be replayed to the retries.
+		if code >= 500 || r.Context().Err() != nil {
+			ttl = 0
+		}
+		maxBytes := DefaultReplayMaxBytes
+		if ah.ReplayMaxBytes != 0 {
+			maxBytes = ah.ReplayMaxBytes
+		}
+		ah.replay.finish(slug, call, page.buf.Bytes(), ttl, maxBytes)
+	}()
+	code = ah.serve(page, r)
+}
+
+// replayKey returns the key of the replies to the request at uri,
+// which is its slug. The last fragment of a message is keyed by
+// the message instead, as it gets a fresh slug when retried, and
+// the retry has to get the reply to the message handled already.
+func replayKey(uri string) string {
+	slug := getcodec.Slug(uri)
+	if slug == "" {
+		return ""
+	}
+	frag, err := getcodec.ParseFragment(uri)
+	if err == nil && frag != nil && frag.Index == frag.Count-1 {
+		return "fragment " + frag.String()
+	}
+	return slug
+}
+
+// pageRecorder writes a page to the HTTP response and
+// records it for replaying.
+type pageRecorder struct {
+	w   http.ResponseWriter
+	buf bytes.Buffer
+}
+
+func (pr *pageRecorder) Write(p []byte) (int, error) {
+	pr.buf.Write(p)
+	return pr.w.Write(p)
+}
+
+// Flush flushes the HTTP response.
+func (pr *pageRecorder) Flush() {
+	if f, ok := pr.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// flushWriter flushes the Encoder after every write.
+type flushWriter struct {
+	enc *ampcodec.Encoder
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.enc.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, fw.enc.Flush()
+}
+
+// Flush flushes the Encoder.
+func (fw flushWriter) Flush() error {
+	return fw.enc.Flush()
+}
+
+// canonicalURL returns the URL the page replying to r is served at.
+// AMP caches fetch pages over HTTPS only, even if TLS is
+// terminated in front of the server.
+func canonicalURL(r *http.Request) string {
+	u := &url.URL{
+		Scheme: "https",
+		Host:   r.Host,
+		Path:   r.URL.Path,
+	}
+	return u.String()
+}
+
+// serve handles the request, writes the reply page to w
+// and returns the status of the reply.
+func (ah *Server) serve(w io.Writer, r *http.Request) int {
 	// We always write AMP page even if it has no useful data.
 	enc := ampcodec.NewEncoder(w)
 	enc.UseOldBoilerplate = ah.UseOldAMPBoilerplate
-	defer enc.Close()
+	enc.CanonicalURL = canonicalURL(r)
+	enc.Carrier = ah.Carrier
+	enc.Template = ah.Template
+	enc.Marker = ah.Marker
+	enc.Framed = ah.Framed
+	enc.Padding = ah.Padding
+	enc.Encoding = ah.Encoding
+	enc.Compress = ah.Compress
 	// We do not throw any HTTP errors because clients are not going
 	// to get them anyway (because of the cache middleware).
-	req, err := getcodec.Decode(r.URL.Path)
-	if err != nil {
-		return
+	// Instead, the status is written into the page.
+	var hw io.Writer = enc
+	if ah.FlushOnWrite {
+		hw = flushWriter{enc: enc}
 	}
-	err = ah.Handler.Handle(enc, req)
+	code, message := ah.handle(hw, r)
+	enc.CloseWithStatus(code, message)
+	return code
+}
+
+// handle handles the request writing the reply to w, and returns
+// the status of the reply.
+func (ah *Server) handle(w io.Writer, r *http.Request) (int, string) {
+	req, frag, err := getcodec.DecodeFragment(r.URL.RequestURI())
 	if err != nil {
-		return
+		return http.StatusBadRequest, err.Error()
 	}
-
+	if frag != nil {
+		var complete bool
+		req, complete, err = ah.reassemble(frag, req)
+		switch {
+		case errors.Is(err, ErrFragmentBufferFull):
+			return http.StatusServiceUnavailable, err.Error()
+		case errors.Is(err, ErrFragmentDelivered) && frag.Index != frag.Count-1:
+			return http.StatusAccepted, ""
+		case errors.Is(err, ErrFragmentDelivered):
+			// The reply to the message is no longer kept for replaying.
+			return http.StatusGone, err.Error()
+		case err != nil:
+			return http.StatusBadRequest, err.Error()
+		case !complete && frag.Index == frag.Count-1:
+			// The last fragment is sent after all the others
+			// are acknowledged, so some of them were lost.
+			return http.StatusConflict, "incomplete fragmented request"
+		case !complete:
+			// Fragments are acknowledged with empty pages until
+			// the request is complete.
+			return http.StatusAccepted, ""
+		}
+	}
+	h := ah.ContextHandler
+	if h == nil {
+		h = AdaptHandler(ah.Handler)
+	}
+	err = h.HandleContext(r.Context(), newRequestInfo(r), w, req)
+	var perr *PublicError
+	switch {
+	case errors.As(err, &perr):
+		return http.StatusInternalServerError, perr.Message
+	case err != nil:
+		return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+	}
+	return http.StatusOK, ""
 }
@@ -0,0 +1,134 @@
+package amper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	ampcodec "github.com/unkaktus/amper/codec/amp"
+	getcodec "github.com/unkaktus/amper/codec/get"
+)
+
+func TestContextHandler(t *testing.T) {
+	is := is.New(t)
+	var got *RequestInfo
+	server := &Server{
+		ContextHandler: ContextHandlerFunc(func(ctx context.Context, info *RequestInfo, w io.Writer, r io.Reader) error {
+			is.NoErr(ctx.Err())
+			got = info
+			_, err := io.Copy(w, r)
+			return err
+		}),
+	}
+	reqPath, err := getcodec.Encode(bytes.NewReader([]byte("x")))
+	is.NoErr(err)
+	r := httptest.NewRequest(http.MethodGet, "/"+reqPath, nil)
+	r.Header.Set("X-Forwarded-For", "192.0.2.1, 198.51.100.2")
+	r.Header.Set("User-Agent", "Mozilla/5.0 (compatible; Google-AMPHTML)")
+	server.ServeHTTP(httptest.NewRecorder(), r)
+
+	is.Equal(got.Slug, strings.Split(reqPath, "/")[0])
+	is.Equal(got.RemoteAddr, "192.0.2.1")
+	is.Equal(got.ForwardedFor, []string{"192.0.2.1", "198.51.100.2"})
+	is.Equal(got.CDN, "google")
+}
+
+func TestAdaptHandler(t *testing.T) {
+	is := is.New(t)
+	ln := NewListener()
+	defer ln.Close()
+	_, ok := AdaptHandler(ln).(*Listener)
+	is.True(ok)
+	_, ok = AdaptHandler(echoHandler()).(handlerAdapter)
+	is.True(ok)
+}
+
+func TestServerStatus(t *testing.T) {
+	is := is.New(t)
+	c := newTestClient(t, HandlerFunc(func(w io.Writer, r io.Reader) error {
+		b, _ := io.ReadAll(r)
+		switch string(b) {
+		case "fail":
+			return errors.New("handler failed at /internal/path")
+		case "public":
+			return fmt.Errorf("wrapped: %w", &PublicError{Message: "handler failed"})
+		}
+		return nil
+	}))
+
+	resp, err := c.RoundTrip(bytes.NewReader([]byte("ok")))
+	is.NoErr(err)
+	b, err := io.ReadAll(resp)
+	is.NoErr(err)
+	is.Equal(len(b), 0)
+
+	_, err = c.RoundTrip(bytes.NewReader([]byte("fail")))
+	var serr *ServerError
+	is.True(errors.As(err, &serr))
+	is.Equal(serr.StatusCode, http.StatusInternalServerError)
+	// Internal details are not sent to the CDN.
+	is.Equal(serr.Message, "Internal Server Error")
+
+	_, err = c.RoundTrip(bytes.NewReader([]byte("public")))
+	is.True(errors.As(err, &serr))
+	is.Equal(serr.StatusCode, http.StatusInternalServerError)
+	is.Equal(serr.Message, "handler failed")
+}
+
+func TestServerFlushOnWrite(t *testing.T) {
+	is := is.New(t)
+	proceed := make(chan struct{})
+	ts := httptest.NewServer(&Server{
+		FlushOnWrite: true,
+		Handler: HandlerFunc(func(w io.Writer, r io.Reader) error {
+			w.Write([]byte("abc"))
+			<-proceed
+			w.Write([]byte("def"))
+			return nil
+		}),
+	})
+	defer ts.Close()
+	reqPath, err := getcodec.Encode(bytes.NewReader(nil))
+	is.NoErr(err)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(ts.URL + "/" + reqPath)
+	is.NoErr(err)
+	defer resp.Body.Close()
+
+	// The first write arrives before the handler returns.
+	var page []byte
+	buf := make([]byte, 1024)
+	for !bytes.Contains(page, []byte(`<pre id="data">YWJj`)) {
+		n, err := resp.Body.Read(buf)
+		is.NoErr(err)
+		page = append(page, buf[:n]...)
+	}
+	close(proceed)
+	rest, err := io.ReadAll(resp.Body)
+	is.NoErr(err)
+	data, err := ampcodec.NewDecoder(bytes.NewReader(append(page, rest...)))
+	is.NoErr(err)
+	b, err := io.ReadAll(data)
+	is.NoErr(err)
+	is.Equal(string(b), "abcdef")
+}
+
+func TestServerCanonicalURL(t *testing.T) {
+	is := is.New(t)
+	server := &Server{Handler: echoHandler()}
+	reqPath, err := getcodec.Encode(bytes.NewReader([]byte("x")))
+	is.NoErr(err)
+	r := httptest.NewRequest(http.MethodGet, "http://amp.example.org/"+reqPath, nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	canonical := `<link rel="canonical" href="https://amp.example.org/` + reqPath + `">`
+	is.True(strings.Contains(w.Body.String(), canonical))
+}
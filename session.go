@@ -0,0 +1,456 @@
+// session.go - stream sessions over amper round trips.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of amper, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package amper
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sessions turn stateless round trips into a bidirectional byte stream.
+// Every round trip carries a segment in each direction. A segment holds
+// the stream offset (seq) of its data and the number of bytes received
+// from the peer so far (ack). Unacknowledged data is resent in the next
+// segment, so lost or duplicated round trips are harmless. The end of the
+// stream (FIN) occupies one extra unit of sequence space, as in TCP.
+
+const (
+	flagSYN = 1 << iota
+	flagFIN
+	flagRST
+)
+
+const (
+	sessionIDSize = 16
+	// requestHeaderSize is the size of flags, session ID, seq and ack.
+	requestHeaderSize = 1 + sessionIDSize + 8 + 8
+	// responseHeaderSize is the size of flags, seq and ack.
+	responseHeaderSize = 1 + 8 + 8
+	// maxSendBuffer is the number of unacknowledged bytes
+	// after which Write blocks.
+	maxSendBuffer = 1 << 20
+	// maxRecvBuffer is the number of unread bytes after which
+	// incoming data is dropped to be resent later.
+	maxRecvBuffer = 1 << 20
+)
+
+var errMalformedSegment = errors.New("malformed session segment")
+
+// Addr is the net.Addr of amper sessions.
+type Addr string
+
+// Network returns the name of the network, "amper".
+func (a Addr) Network() string {
+	return "amper"
+}
+
+func (a Addr) String() string {
+	return string(a)
+}
+
+type sessionID [sessionIDSize]byte
+
+func newSessionID() sessionID {
+	var id sessionID
+	_, err := io.ReadFull(rand.Reader, id[:])
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func (id sessionID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+type segment struct {
+	flags byte
+	// id is only present in requests.
+	id   sessionID
+	seq  uint64
+	ack  uint64
+	data []byte
+}
+
+func (s *segment) marshalRequest() []byte {
+	b := make([]byte, requestHeaderSize, requestHeaderSize+len(s.data))
+	b[0] = s.flags
+	copy(b[1:], s.id[:])
+	binary.BigEndian.PutUint64(b[1+sessionIDSize:], s.seq)
+	binary.BigEndian.PutUint64(b[1+sessionIDSize+8:], s.ack)
+	return append(b, s.data...)
+}
+
+func (s *segment) marshalResponse() []byte {
+	b := make([]byte, responseHeaderSize, responseHeaderSize+len(s.data))
+	b[0] = s.flags
+	binary.BigEndian.PutUint64(b[1:], s.seq)
+	binary.BigEndian.PutUint64(b[1+8:], s.ack)
+	return append(b, s.data...)
+}
+
+func parseRequest(b []byte) (*segment, error) {
+	if len(b) < requestHeaderSize {
+		return nil, errMalformedSegment
+	}
+	s := &segment{flags: b[0]}
+	copy(s.id[:], b[1:])
+	s.seq = binary.BigEndian.Uint64(b[1+sessionIDSize:])
+	s.ack = binary.BigEndian.Uint64(b[1+sessionIDSize+8:])
+	s.data = b[requestHeaderSize:]
+	return s, nil
+}
+
+func parseResponse(b []byte) (*segment, error) {
+	if len(b) < responseHeaderSize {
+		return nil, errMalformedSegment
+	}
+	s := &segment{flags: b[0]}
+	s.seq = binary.BigEndian.Uint64(b[1:])
+	s.ack = binary.BigEndian.Uint64(b[1+8:])
+	s.data = b[responseHeaderSize:]
+	return s, nil
+}
+
+// notify wakes up a waiter on c, if any.
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// deadline is an abstraction for handling timeouts.
+// It is the same as pipeDeadline in net.Pipe.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+// set sets the point in time when the deadline will time out.
+// A zero value for t prevents timeout.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // Wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		d.timer = time.AfterFunc(dur, func() {
+			close(d.cancel)
+		})
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed when the deadline is exceeded.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+// stream is the transport-agnostic part of a session, shared
+// by both client and server ends. It implements net.Conn.
+type stream struct {
+	mu sync.Mutex
+	// recvBuf holds received data not yet read.
+	recvBuf bytes.Buffer
+	// recvNext is the offset of the next expected byte.
+	recvNext  uint64
+	remoteFIN bool
+	// sendBuf holds unacknowledged data starting at offset sendUna.
+	sendBuf  []byte
+	sendUna  uint64
+	finAcked bool
+	closed   bool
+	err      error
+
+	readable  chan struct{}
+	writable  chan struct{}
+	pending   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	readDeadline  deadline
+	writeDeadline deadline
+
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func newStream(localAddr, remoteAddr net.Addr) *stream {
+	return &stream{
+		readable:      make(chan struct{}, 1),
+		writable:      make(chan struct{}, 1),
+		pending:       make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+		localAddr:     localAddr,
+		remoteAddr:    remoteAddr,
+	}
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	for {
+		if isClosedChan(s.readDeadline.wait()) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		s.mu.Lock()
+		switch {
+		case s.closed:
+			s.mu.Unlock()
+			return 0, net.ErrClosed
+		case s.recvBuf.Len() > 0:
+			n, _ := s.recvBuf.Read(p)
+			s.mu.Unlock()
+			return n, nil
+		case s.remoteFIN:
+			s.mu.Unlock()
+			return 0, io.EOF
+		case s.err != nil:
+			err := s.err
+			s.mu.Unlock()
+			return 0, err
+		}
+		s.mu.Unlock()
+		if len(p) == 0 {
+			return 0, nil
+		}
+		select {
+		case <-s.readable:
+		case <-s.done:
+		case <-s.readDeadline.wait():
+		}
+	}
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	n := 0
+	for {
+		if isClosedChan(s.writeDeadline.wait()) {
+			return n, os.ErrDeadlineExceeded
+		}
+		s.mu.Lock()
+		switch {
+		case s.closed:
+			s.mu.Unlock()
+			return n, net.ErrClosed
+		case s.err != nil:
+			err := s.err
+			s.mu.Unlock()
+			return n, err
+		}
+		if room := maxSendBuffer - len(s.sendBuf); room > 0 {
+			k := min(room, len(p))
+			s.sendBuf = append(s.sendBuf, p[:k]...)
+			p = p[k:]
+			n += k
+			notify(s.pending)
+		}
+		s.mu.Unlock()
+		if len(p) == 0 {
+			return n, nil
+		}
+		select {
+		case <-s.writable:
+		case <-s.done:
+		case <-s.writeDeadline.wait():
+		}
+	}
+}
+
+// Close closes the stream. Data written before Close is still
+// delivered to the peer, followed by the end of stream.
+func (s *stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return net.ErrClosed
+	}
+	s.closed = true
+	s.closeOnce.Do(func() { close(s.done) })
+	notify(s.pending)
+	return nil
+}
+
+// fail aborts the stream with err.
+func (s *stream) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+// failure returns the error the stream was aborted with, if any.
+func (s *stream) failure() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *stream) LocalAddr() net.Addr {
+	return s.localAddr
+}
+
+func (s *stream) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
+func (s *stream) SetDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	s.writeDeadline.set(t)
+	return nil
+}
+
+func (s *stream) SetReadDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	return nil
+}
+
+func (s *stream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// outgoing returns up to max bytes of unacknowledged data together with
+// its offset, and whether the end of stream is to be sent along.
+func (s *stream) outgoing(max int) (seq uint64, data []byte, fin bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := min(len(s.sendBuf), max)
+	data = append([]byte(nil), s.sendBuf[:n]...)
+	fin = s.closed && !s.finAcked && n == len(s.sendBuf)
+	return s.sendUna, data, fin
+}
+
+// hasOutgoing reports whether there is anything to send to the peer.
+func (s *stream) hasOutgoing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sendBuf) != 0 || (s.closed && !s.finAcked)
+}
+
+// acknowledge drops the data acknowledged by the peer.
+// It reports whether the acknowledgement made any progress.
+func (s *stream) acknowledge(ack uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	end := s.sendUna + uint64(len(s.sendBuf))
+	progress := false
+	if ack > end {
+		if s.closed && ack == end+1 && !s.finAcked {
+			s.finAcked = true
+			progress = true
+		}
+		ack = end
+	}
+	if ack > s.sendUna {
+		s.sendBuf = s.sendBuf[ack-s.sendUna:]
+		s.sendUna = ack
+		notify(s.writable)
+		progress = true
+	}
+	return progress
+}
+
+// deliver accepts data at offset seq from the peer.
+// It reports whether any new data or end of stream was accepted.
+func (s *stream) deliver(seq uint64, data []byte, fin bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq > s.recvNext {
+		// We never have more than one segment in flight,
+		// so there cannot be gaps.
+		return false
+	}
+	progress := false
+	if skip := s.recvNext - seq; skip < uint64(len(data)) {
+		fresh := data[skip:]
+		if !s.closed {
+			fresh = fresh[:min(len(fresh), maxRecvBuffer-s.recvBuf.Len())]
+			s.recvBuf.Write(fresh)
+		}
+		s.recvNext += uint64(len(fresh))
+		progress = len(fresh) != 0
+	}
+	if fin && !s.remoteFIN && seq+uint64(len(data)) == s.recvNext {
+		s.remoteFIN = true
+		progress = true
+	}
+	if progress {
+		notify(s.readable)
+	}
+	return progress
+}
+
+// ackNumber returns the acknowledgement to send to the peer.
+func (s *stream) ackNumber() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.remoteFIN {
+		return s.recvNext + 1
+	}
+	return s.recvNext
+}
+
+// finished reports whether the stream is closed and
+// the peer has received everything we sent.
+func (s *stream) finished() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed && s.finAcked
+}
+
+// closedBoth reports whether both ends of the stream are closed.
+func (s *stream) closedBoth() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed && s.remoteFIN
+}
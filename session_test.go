@@ -0,0 +1,134 @@
+package amper
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestSession(t *testing.T) {
+	is := is.New(t)
+	ln := NewListener()
+	defer ln.Close()
+	c := newTestClient(t, ln)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := Dial(ctx, c)
+	is.NoErr(err)
+
+	input := make([]byte, 20000)
+	_, err = rand.Read(input)
+	is.NoErr(err)
+	go func() {
+		conn.Write(input)
+	}()
+	output := make([]byte, len(input))
+	_, err = io.ReadFull(conn, output)
+	is.NoErr(err)
+	is.True(bytes.Equal(output, input))
+	is.NoErr(conn.Close())
+}
+
+func TestSessionEOF(t *testing.T) {
+	is := is.New(t)
+	ln := NewListener()
+	defer ln.Close()
+	c := newTestClient(t, ln)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("bye"))
+		conn.Close()
+	}()
+
+	conn, err := Dial(context.Background(), c)
+	is.NoErr(err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	b, err := io.ReadAll(conn)
+	is.NoErr(err)
+	is.Equal(string(b), "bye")
+}
+
+func TestSessionReadDeadline(t *testing.T) {
+	is := is.New(t)
+	ln := NewListener()
+	defer ln.Close()
+	c := newTestClient(t, ln)
+
+	conn, err := Dial(context.Background(), c)
+	is.NoErr(err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	is.True(errors.Is(err, os.ErrDeadlineExceeded))
+	var nerr net.Error
+	is.True(errors.As(err, &nerr) && nerr.Timeout())
+}
+
+func TestSessionReset(t *testing.T) {
+	is := is.New(t)
+	ln := NewListener()
+	c := newTestClient(t, ln)
+
+	conn, err := Dial(context.Background(), c)
+	is.NoErr(err)
+	defer conn.Close()
+	ln.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	is.True(errors.Is(err, ErrSessionReset))
+}
+
+func TestListenerLinger(t *testing.T) {
+	is := is.New(t)
+	ln := NewListener()
+	defer ln.Close()
+	roundTrip := func(req *segment) *segment {
+		buf := &bytes.Buffer{}
+		is.NoErr(ln.Handle(buf, bytes.NewReader(req.marshalRequest())))
+		resp, err := parseResponse(buf.Bytes())
+		is.NoErr(err)
+		return resp
+	}
+	id := newSessionID()
+	roundTrip(&segment{flags: flagSYN, id: id})
+	conn, err := ln.Accept()
+	is.NoErr(err)
+	is.NoErr(conn.Close())
+
+	// The reply carrying our end of stream is lost,
+	// so the peer retransmits its end of stream.
+	fin := &segment{flags: flagFIN, id: id}
+	resp := roundTrip(fin)
+	is.Equal(resp.flags, byte(flagFIN))
+	resp = roundTrip(fin)
+	is.Equal(resp.flags, byte(flagFIN))
+	is.Equal(resp.ack, uint64(1))
+
+	// Once the peer acknowledges it, the session is gone.
+	roundTrip(&segment{id: id, seq: 1, ack: 1})
+	resp = roundTrip(&segment{id: id, seq: 1, ack: 1})
+	is.Equal(resp.flags, byte(flagRST))
+}
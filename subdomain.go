@@ -0,0 +1,99 @@
+// subdomain.go - AMP cache subdomain mapping.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of amper, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package amper
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// maxLabelLength is the maximum length of a DNS label.
+const maxLabelLength = 63
+
+// fallbackEncoding is lower-case Base32 without padding.
+var fallbackEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// humanReadableSubdomain implements the basic algorithm of
+// https://amp.dev/documentation/guides-and-tutorials/learn/amp-caches-and-cors/amp-cache-urls/#basic-algorithm
+func humanReadableSubdomain(domain string) (string, error) {
+	// Punycode decode the domain.
+	s, err := idna.Lookup.ToUnicode(domain)
+	if err != nil {
+		return "", err
+	}
+	s = strings.Replace(s, "-", "--", -1)
+	s = strings.Replace(s, ".", "-", -1)
+	// Avoid hyphens at positions 3 and 4, which are reserved
+	// for IDNA prefixes like "xn--". Positions are of characters.
+	if r := []rune(s); len(r) >= 4 && r[2] == '-' && r[3] == '-' {
+		s = "0-" + s + "-0"
+	}
+	// Punycode encode the result.
+	return idna.Punycode.ToASCII(s)
+}
+
+// isLTR and isRTL tell the direction of r the way amp-toolbox does.
+func isLTR(r rune) bool {
+	switch {
+	case r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z',
+		r >= 0x00c0 && r <= 0x00d6, r >= 0x00d8 && r <= 0x00f6,
+		r >= 0x00f8 && r <= 0x02b8, r >= 0x0300 && r <= 0x0590,
+		r >= 0x0800 && r <= 0x1fff, r == 0x200e,
+		r >= 0x2c00 && r <= 0xfb1c, r >= 0xfe00 && r <= 0xfe6f,
+		r >= 0xfefd && r <= 0xffff:
+		return true
+	}
+	return false
+}
+
+func isRTL(r rune) bool {
+	switch {
+	case r >= 0x0591 && r <= 0x06ef, r >= 0x06fa && r <= 0x07ff,
+		r >= 0xfb1d && r <= 0xfdff, r >= 0xfe70 && r <= 0xfefc:
+		return true
+	}
+	return false
+}
+
+// isMixedDirection tells whether domain has characters
+// of both left-to-right and right-to-left scripts.
+func isMixedDirection(domain string) bool {
+	s, err := idna.Lookup.ToUnicode(domain)
+	if err != nil {
+		return false
+	}
+	return strings.IndexFunc(s, isLTR) >= 0 && strings.IndexFunc(s, isRTL) >= 0
+}
+
+// fallbackSubdomain implements the fallback algorithm of
+// https://amp.dev/documentation/guides-and-tutorials/learn/amp-caches-and-cors/amp-cache-urls/#fallback-algorithm
+func fallbackSubdomain(domain string) string {
+	h := sha256.Sum256([]byte(domain))
+	return fallbackEncoding.EncodeToString(h[:])
+}
+
+// AMPCacheSubdomain returns the label AMP caches use as the
+// subdomain for documents of domain. It implements the
+// AMP cache URL format, including internationalized domains
+// and the fallback to a hash for domains which do not map
+// into a valid DNS label or mix text directions.
+func AMPCacheSubdomain(domain string) string {
+	domain, err := idna.Lookup.ToASCII(strings.ToLower(domain))
+	if err != nil || len(domain) > maxLabelLength || !strings.Contains(domain, ".") ||
+		isMixedDirection(domain) {
+		return fallbackSubdomain(domain)
+	}
+	s, err := humanReadableSubdomain(domain)
+	if err != nil || len(s) > maxLabelLength {
+		return fallbackSubdomain(domain)
+	}
+	return s
+}
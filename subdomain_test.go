@@ -0,0 +1,52 @@
+package amper
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestAMPCacheSubdomain(t *testing.T) {
+	for _, tc := range []struct {
+		domain    string
+		subdomain string
+	}{
+		// Examples from
+		// https://amp.dev/documentation/guides-and-tutorials/learn/amp-caches-and-cors/amp-cache-urls/
+		{"example.com", "example-com"},
+		{"foo.example.com", "foo-example-com"},
+		{"foo-example.com", "foo--example-com"},
+		{"xn--57hw060o.com", "xn---com-p33b41770a"},
+		{"⚡😊.com", "xn---com-p33b41770a"},
+		{"en-us.example.com", "0-en--us-example-com-0"},
+		{"Example.COM", "example-com"},
+		{"amp.unkaktus.art", "amp-unkaktus-art"},
+		// Hyphen positions are counted in characters.
+		{"ä-b.com", "xn----b-com-4wa"},
+		{"äb-c.com", "xn--0-b--c-com-0-hcb"},
+		// Right-to-left domains are fine unless mixed with left-to-right.
+		{"עברית.קום", "xn----1hcnowz2bft"},
+		{"עברית.example.com", "zk7n73bjgz27u6j7djj4w33os5d4jmjvubhw5xgi3kfxmtjqlfsa"},
+		{
+			"itwasadarkandstormynight.therainfellintorrents.exceptatoccasionalintervalswhenitwascheckedby.aviolentgustofwindwhichsweptupthestreets.com",
+			"dgz4cnrxufaulnwku4ow5biptyqnenjievjht56hd7wqinbdbteq",
+		},
+	} {
+		t.Run(tc.domain, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(AMPCacheSubdomain(tc.domain), tc.subdomain)
+		})
+	}
+}
+
+func TestAMPCacheSubdomainFallback(t *testing.T) {
+	is := is.New(t)
+	for _, domain := range []string{
+		"localhost",
+		"a-very-long-hostname-that-does-not-fit-into-a-single-label.example.com",
+	} {
+		s := AMPCacheSubdomain(domain)
+		is.Equal(len(s), 52)
+		is.Equal(s, fallbackSubdomain(domain))
+	}
+}